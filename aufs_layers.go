@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/docker/docker/pkg/archive"
+)
+
+var errReadOnlyDriver = errors.New("the aufs layers are opened read-only, this needs the aufs driver")
+
+// aufsLayers reads the aufs layers without the aufs driver, whose init
+// needs CAP_SYS_ADMIN. It is enough to read the graph and stream the layers
+type aufsLayers struct {
+	home string
+}
+
+func newAufsLayers(root string) *aufsLayers {
+	return &aufsLayers{home: filepath.Join(root, "aufs")}
+}
+
+func (a *aufsLayers) String() string {
+	return "aufs"
+}
+
+func (a *aufsLayers) Create(id, parent string) error {
+	return errReadOnlyDriver
+}
+
+func (a *aufsLayers) Remove(id string) error {
+	return errReadOnlyDriver
+}
+
+func (a *aufsLayers) Get(id, mountLabel string) (string, error) {
+	return "", errReadOnlyDriver
+}
+
+func (a *aufsLayers) Put(id string) error {
+	return nil
+}
+
+func (a *aufsLayers) Exists(id string) bool {
+	_, err := os.Lstat(filepath.Join(a.home, "layers", id))
+	return err == nil
+}
+
+func (a *aufsLayers) Status() [][2]string {
+	return [][2]string{
+		{"Root Dir", a.home},
+		{"Mode", "read-only"},
+	}
+}
+
+func (a *aufsLayers) GetMetadata(id string) (map[string]string, error) {
+	return nil, nil
+}
+
+func (a *aufsLayers) Cleanup() error {
+	return nil
+}
+
+// (a *aufsLayers) Diff is the aufs driver Diff, the diff directory is the layer
+func (a *aufsLayers) Diff(id, parent string) (archive.Archive, error) {
+	return archive.TarWithOptions(filepath.Join(a.home, "diff", id), &archive.TarOptions{
+		Compression:     archive.Uncompressed,
+		ExcludePatterns: []string{".wh..wh.*"},
+	})
+}
+
+func (a *aufsLayers) Changes(id, parent string) ([]archive.Change, error) {
+	return nil, errReadOnlyDriver
+}
+
+func (a *aufsLayers) ApplyDiff(id, parent string, diff archive.Reader) (int64, error) {
+	return 0, errReadOnlyDriver
+}
+
+// (a *aufsLayers) DiffSize sums the files of the diff directory, hardlinks once
+func (a *aufsLayers) DiffSize(id, parent string) (int64, error) {
+	var size int64
+	seen := map[uint64]bool{}
+	err := filepath.Walk(filepath.Join(a.home, "diff", id), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Nlink > 1 {
+			if seen[uint64(stat.Ino)] {
+				return nil
+			}
+			seen[uint64(stat.Ino)] = true
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
@@ -2,123 +2,168 @@ package main
 
 import (
 	"archive/tar"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
-	"path/filepath"
 	"runtime"
-	"strings"
 
 	"encoding/json"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/opencontainers/runc/libcontainer/user"
+	ocispecs "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/opencontainers/specs"
-	"golang.org/x/sys/unix"
 )
 
 // (g GraphTool) Bundle  ...
-func (g *GraphTool) Bundle(imageName string, dst string) error {
-	tmpDir, err := ioutil.TempDir(os.TempDir(), "dg-bundle")
-	if err != nil {
-		return err
+func (g *GraphTool) Bundle(imageName string, dst string, options *BundleOptions) error {
+	if options == nil {
+		options = &BundleOptions{}
 	}
-
-	tmpMount := tmpDir + "/mount"
-	tmpRoot := tmpDir + "/rootfs"
-
-	if err := os.MkdirAll(tmpMount, 0755); err != nil {
-		g.logger.Error(err.Error())
+	if options.Format == "" {
+		options.Format = bundleFormatTar
 	}
-
-	if err := g.Mount(imageName, tmpMount, []string{"ro", "nosuid"}); err != nil {
-		g.logger.Error(err.Error())
+	if options.Format != bundleFormatTar && options.Format != bundleFormatDir {
+		return fmt.Errorf("unknown bundle format %q", options.Format)
 	}
-
-	if err := os.MkdirAll(tmpRoot, 0755); err != nil {
-		g.logger.Error(err.Error())
+	if options.SpecVersion == "" {
+		options.SpecVersion = ocispecs.Version
+	}
+	if options.SpecVersion != ocispecs.Version && options.SpecVersion != specs.Version {
+		return fmt.Errorf("unsupported spec version %q, use %s or the legacy %s", options.SpecVersion, ocispecs.Version, specs.Version)
+	}
+	if options.Format == bundleFormatDir {
+		if dst == "-" {
+			return fmt.Errorf("a directory bundle can't be written to stdout")
+		}
+		if options.Compress != "" && options.Compress != "none" {
+			return fmt.Errorf("a directory bundle can't be compressed")
+		}
 	}
 
-	var bytesCopied int64
-
-	tarFile, err := os.Create(dst)
+	compression, err := parseCompression(options.Compress, dst)
 	if err != nil {
 		return err
 	}
 
-	tarArchive := tar.NewWriter(tarFile)
-	// Order is important
-	defer g.Unmount(tmpMount)
-	defer os.RemoveAll(tmpDir)
-	defer tarArchive.Close()
-
-	err = g.specFiles(tarArchive)
+	img, err := g.LookupImage(imageName)
 	if err != nil {
-		g.logger.Error(err.Error())
+		return err
 	}
 
-	if err := filepath.Walk(tmpMount, func(path string, info os.FileInfo, err error) error {
-		dstFile := filepath.Join("rootfs", strings.TrimPrefix(path, tmpMount))
-		var link string
-		if info.Mode()&os.ModeSymlink != 0 {
-			link, err = os.Readlink(path)
-			if err != nil {
-				return err
-			}
+	var (
+		process specs.Process
+		rootfs  rootfsWriter
+	)
+	if options.Rootless {
+		layers, err := g.newLayerRootfs(img)
+		if err != nil {
+			return err
 		}
-
-		hdr, err := tar.FileInfoHeader(info, link)
+		if process, err = g.bundleProcess(img, layers.resolveUser, options); err != nil {
+			return err
+		}
+		rootfs = layers.writeTo
+	} else {
+		tmpDir, err := ioutil.TempDir(os.TempDir(), "dg-bundle")
 		if err != nil {
 			return err
 		}
+		defer os.RemoveAll(tmpDir)
 
-		hdr.Name = dstFile
+		tmpMount := tmpDir + "/mount"
+		if err := os.MkdirAll(tmpMount, 0755); err != nil {
+			return err
+		}
 
-		if err := tarArchive.WriteHeader(hdr); err != nil {
+		if err := g.Mount(img.ID, tmpMount, []string{"ro", "nosuid"}, mountReadOnly); err != nil {
 			return err
 		}
+		// Runs before the removal of tmpDir
+		defer g.Unmount(tmpMount, false)
 
-		if info.Mode().IsRegular() {
-			if n, err := g.tarCp(path, tarArchive); err != nil {
-				return err
-			} else {
-				bytesCopied += n
-			}
+		resolve := func(userSpec string) (*user.ExecUser, error) {
+			return resolveUser(tmpMount, userSpec)
+		}
+		if process, err = g.bundleProcess(img, resolve, options); err != nil {
+			return err
+		}
+		rootfs = func(tw *tar.Writer, prefix string) (int64, error) {
+			return g.tarRootfs(tw, tmpMount, prefix)
 		}
-		return nil
-	}); err != nil {
-		g.logger.Error(err.Error())
 	}
 
-	g.logger.Infof("%d MB copied", bytesCopied/1024)
-	return nil
-}
-
-func (g *GraphTool) tarCp(srcName string, tw *tar.Writer) (int64, error) {
-	var (
-		src *os.File
-		err error
-	)
+	// The spec files are checked before the bundle is written
+	files, err := g.specFiles(process, options.SpecVersion)
+	if err != nil {
+		return err
+	}
 
-	if src, err = os.Open(srcName); err != nil {
-		return 0, err
+	if options.Format == bundleFormatDir {
+		return g.bundleDir(dst, rootfs, files)
 	}
-	defer src.Close()
 
-	srcStat, err := src.Stat()
+	out, err := createOutput(dst, compression)
 	if err != nil {
-		g.logger.Error(err.Error())
-	} else if err := unix.Fadvise(int(src.Fd()), 0, srcStat.Size(), unix.MADV_SEQUENTIAL); err != nil {
-		g.logger.Error(err.Error())
+		return err
+	}
+	err = g.writeBundle(tar.NewWriter(out), rootfs, files)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil && dst != "-" {
+		// No partial bundle is left behind
+		os.Remove(dst)
 	}
+	return err
+}
 
-	if n, err := io.Copy(tw, src); err != nil {
-		g.logger.Error(err.Error())
-	} else {
-		return n, nil
+// (g *GraphTool) bundleDir lays the bundle out in the directory dst,
+// ready to be used by runc
+func (g *GraphTool) bundleDir(dst string, rootfs rootfsWriter, files []bundleFile) error {
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+	if entries, err := ioutil.ReadDir(dst); err != nil {
+		return err
+	} else if len(entries) > 0 {
+		return fmt.Errorf("bundle directory %s is not empty", dst)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(g.writeBundle(tar.NewWriter(pw), rootfs, files))
+	}()
+	defer pr.Close()
+
+	// The owners can only be kept by root
+	return archive.UntarUncompressed(pr, dst, &archive.TarOptions{NoLchown: os.Getuid() != 0})
+}
+
+// rootfsWriter writes the bundle rootfs to tw with its paths under prefix,
+// it returns the number of bytes of file content written
+type rootfsWriter func(tw *tar.Writer, prefix string) (int64, error)
+
+// (g *GraphTool) writeBundle writes the spec files and rootfs to tw and closes it
+func (g *GraphTool) writeBundle(tarArchive *tar.Writer, rootfs rootfsWriter, files []bundleFile) error {
+	for _, file := range files {
+		if err := writeTarFile(tarArchive, file.name, file.data); err != nil {
+			return err
+		}
 	}
 
-	return 0, nil
+	bytesCopied, err := rootfs(tarArchive, "rootfs")
+	if err != nil {
+		return err
+	}
+
+	g.logger.Infof("%d MB copied", bytesCopied/1024/1024)
+	return tarArchive.Close()
 }
 
-func (g *GraphTool) specFiles(tw *tar.Writer) error {
+// legacySpec returns the config.json and runtime.json of the pre 1.0
+// runtime-spec, they are also the defaults mapped to the 1.x config.json
+func legacySpec(process specs.Process) (specs.LinuxSpec, specs.LinuxRuntimeSpec) {
 	// shameless copy from https://github.com/opencontainers/runc/blob/master/spec.go
 	spec := specs.LinuxSpec{
 		Spec: specs.Spec{
@@ -131,17 +176,7 @@ func (g *GraphTool) specFiles(tw *tar.Writer) error {
 				Path:     "rootfs",
 				Readonly: true,
 			},
-			Process: specs.Process{
-				Terminal: true,
-				User:     specs.User{},
-				Args: []string{
-					"sh",
-				},
-				Env: []string{
-					"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
-					"TERM=xterm",
-				},
-			},
+			Process:  process,
 			Hostname: "shell",
 			Mounts: []specs.MountPoint{
 				{
@@ -320,33 +355,53 @@ func (g *GraphTool) specFiles(tw *tar.Writer) error {
 			},
 		},
 	}
+	return spec, rspec
+}
+
+// bundleFile is a file written at the top of the bundle
+type bundleFile struct {
+	name string
+	data []byte
+}
+
+// (g *GraphTool) specFiles returns the spec files of specVersion
+func (g *GraphTool) specFiles(process specs.Process, specVersion string) ([]bundleFile, error) {
+	spec, rspec := legacySpec(process)
+
+	if specVersion != specs.Version {
+		data, err := json.MarshalIndent(ociSpec(spec, rspec), "", "\t")
+		if err != nil {
+			return nil, err
+		}
+		if err := validateOCISpec(data); err != nil {
+			return nil, err
+		}
+		return []bundleFile{{"config.json", data}}, nil
+	}
+
 	specData, err := json.MarshalIndent(spec, "", "\t")
 	if err != nil {
-		return nil
+		return nil, err
 	}
 
 	rspecData, err := json.MarshalIndent(rspec, "", "\t")
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	hdrConfig := &tar.Header{
-		Name: "config.json",
-		Size: int64(len(specData)),
-	}
-	tw.WriteHeader(hdrConfig)
-	if _, err := tw.Write(specData); err != nil {
-		return err
-	}
+	return []bundleFile{{"config.json", specData}, {"runtime.json", rspecData}}, nil
+}
 
-	hdrRun := &tar.Header{
-		Name: "runtime.json",
-		Size: int64(len(rspecData)),
+// writeTarFile writes a regular file holding data to tw
+func writeTarFile(tw *tar.Writer, name string, data []byte) error {
+	hdr := &tar.Header{
+		Name: name,
+		Mode: 0644,
+		Size: int64(len(data)),
 	}
-	tw.WriteHeader(hdrRun)
-	if _, err := tw.Write(rspecData); err != nil {
+	if err := tw.WriteHeader(hdr); err != nil {
 		return err
 	}
-
-	return nil
+	_, err := tw.Write(data)
+	return err
 }
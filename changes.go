@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/autogen/dockerversion"
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/pkg/stringid"
+	"github.com/docker/docker/pkg/stringutils"
+	"github.com/docker/docker/runconfig"
+)
+
+// copyConfig returns a deep copy of config, a nil config gives an empty one
+func copyConfig(config *runconfig.Config) (*runconfig.Config, error) {
+	newConfig := &runconfig.Config{}
+	if config == nil {
+		return newConfig, nil
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, newConfig); err != nil {
+		return nil, err
+	}
+	return newConfig, nil
+}
+
+// newChildImage returns a new image on top of parent, nil for a base image,
+// with a copy of config. Its container config runs step as a no-op the way
+// docker build records the steps without a container, docker history shows it
+func newChildImage(parent *image.Image, comment string, config *runconfig.Config, step string) (*image.Image, error) {
+	config, err := copyConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	containerConfig, err := copyConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	containerConfig.Cmd = stringutils.NewStrSlice("/bin/sh", "-c", "#(nop) "+step)
+
+	img := &image.Image{
+		ID:              stringid.GenerateRandomID(),
+		Comment:         comment,
+		Created:         time.Now().UTC(),
+		ContainerConfig: *containerConfig,
+		DockerVersion:   dockerversion.VERSION,
+		Config:          config,
+		Architecture:    runtime.GOARCH,
+		OS:              runtime.GOOS,
+	}
+	if parent != nil {
+		img.Parent = parent.ID
+	}
+	return img, nil
+}
+
+// applyChanges applies Dockerfile style instructions (ENV, CMD, ENTRYPOINT,
+// LABEL, WORKDIR and USER) to config
+func applyChanges(config *runconfig.Config, changes []string) error {
+	for _, change := range changes {
+		change = strings.TrimSpace(change)
+		if change == "" {
+			continue
+		}
+
+		parts := strings.SplitN(change, " ", 2)
+		instruction := strings.ToUpper(parts[0])
+		args := ""
+		if len(parts) > 1 {
+			args = strings.TrimSpace(parts[1])
+		}
+		if args == "" {
+			return fmt.Errorf("%s requires at least one argument", instruction)
+		}
+
+		switch instruction {
+		case "ENV":
+			pairs, err := parseKeyValues(args, true)
+			if err != nil {
+				return fmt.Errorf("ENV: %v", err)
+			}
+			for _, kv := range pairs {
+				config.Env = setEnv(config.Env, kv[0], kv[1])
+			}
+		case "LABEL":
+			pairs, err := parseKeyValues(args, false)
+			if err != nil {
+				return fmt.Errorf("LABEL: %v", err)
+			}
+			if config.Labels == nil {
+				config.Labels = make(map[string]string)
+			}
+			for _, kv := range pairs {
+				config.Labels[kv[0]] = kv[1]
+			}
+		case "CMD":
+			cmd, err := parseCommand(args)
+			if err != nil {
+				return fmt.Errorf("CMD: %v", err)
+			}
+			config.Cmd = stringutils.NewStrSlice(cmd...)
+		case "ENTRYPOINT":
+			entrypoint, err := parseCommand(args)
+			if err != nil {
+				return fmt.Errorf("ENTRYPOINT: %v", err)
+			}
+			config.Entrypoint = stringutils.NewStrSlice(entrypoint...)
+			// like docker build, a new entrypoint resets the inherited cmd
+			config.Cmd = nil
+		case "WORKDIR":
+			workdir := args
+			if !filepath.IsAbs(workdir) {
+				workdir = filepath.Join("/", config.WorkingDir, workdir)
+			}
+			config.WorkingDir = filepath.Clean(workdir)
+		case "USER":
+			config.User = args
+		default:
+			return fmt.Errorf("unsupported change instruction %q", parts[0])
+		}
+	}
+	return nil
+}
+
+// parseCommand parses the json (exec) or shell form of CMD and ENTRYPOINT
+func parseCommand(args string) ([]string, error) {
+	if strings.HasPrefix(args, "[") {
+		var cmd []string
+		if err := json.Unmarshal([]byte(args), &cmd); err != nil {
+			return nil, err
+		}
+		return cmd, nil
+	}
+	return []string{"/bin/sh", "-c", args}, nil
+}
+
+// parseKeyValues parses `k=v k2="v 2"` pairs, when legacy is set the
+// `ENV key value` form is also accepted
+func parseKeyValues(args string, legacy bool) ([][2]string, error) {
+	words, err := splitWords(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if legacy && !strings.Contains(words[0], "=") {
+		parts := strings.SplitN(args, " ", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s needs a value", args)
+		}
+		return [][2]string{{parts[0], strings.TrimSpace(parts[1])}}, nil
+	}
+
+	pairs := [][2]string{}
+	for _, word := range words {
+		kv := strings.SplitN(word, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("%q is not in key=value format", word)
+		}
+		pairs = append(pairs, [2]string{kv[0], kv[1]})
+	}
+	return pairs, nil
+}
+
+// splitWords splits s on whitespace, honoring double quotes
+func splitWords(s string) ([]string, error) {
+	var (
+		words   []string
+		word    []rune
+		inQuote bool
+		escaped bool
+		inWord  bool
+	)
+	for _, c := range s {
+		switch {
+		case escaped:
+			word = append(word, c)
+			escaped = false
+		case c == '\\':
+			escaped = true
+			inWord = true
+		case c == '"':
+			inQuote = !inQuote
+			inWord = true
+		case (c == ' ' || c == '\t') && !inQuote:
+			if inWord {
+				words = append(words, string(word))
+				word = word[:0]
+				inWord = false
+			}
+		default:
+			word = append(word, c)
+			inWord = true
+		}
+	}
+	if inQuote {
+		return nil, fmt.Errorf("unterminated quote in %q", s)
+	}
+	if inWord {
+		words = append(words, string(word))
+	}
+	return words, nil
+}
+
+// setEnv sets key to value in env, replacing an existing definition
+func setEnv(env []string, key, value string) []string {
+	for i, e := range env {
+		if strings.SplitN(e, "=", 2)[0] == key {
+			env[i] = key + "=" + value
+			return env
+		}
+	}
+	return append(env, key+"="+value)
+}
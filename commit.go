@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/pkg/parsers"
+)
+
+// (g *GraphTool) Commit turns the changes made on a writable mount into a new
+// image, target is the mount point or the temporary layer id.
+// The mount is released and the new image is tagged as repoTag
+func (g *GraphTool) Commit(target, repoTag, message, author string, changes []string) (*image.Image, error) {
+	record, err := g.mountStore.Lookup(target)
+	if err != nil {
+		return nil, err
+	}
+	if !record.Writable {
+		return nil, fmt.Errorf("%s was not mounted with --rw", record.MountPoint)
+	}
+
+	repo, tag := parsers.ParseRepositoryTag(repoTag)
+	if repo == "" {
+		return nil, fmt.Errorf("invalid repository name %q", repoTag)
+	}
+	unlock, err := g.lockGraph()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	parent, err := g.graphHandler.Get(record.Image)
+	if err != nil {
+		return nil, err
+	}
+
+	// Validate the changes before touching the mount
+	config, err := copyConfig(parent.Config)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyChanges(config, changes); err != nil {
+		return nil, err
+	}
+
+	img, err := newChildImage(parent, message, config, "dg commit")
+	if err != nil {
+		return nil, err
+	}
+	img.Author = author
+
+	if err := syscall.Unmount(record.MountPoint, 0); err != nil && err != syscall.EINVAL {
+		return nil, fmt.Errorf("unmount %s: %v", record.MountPoint, err)
+	}
+
+	diff, err := g.graphDriver.Diff(record.Layer, record.Image)
+	if err != nil {
+		return nil, err
+	}
+	defer diff.Close()
+
+	if err := g.registerImage(img, diff, repo, tag); err != nil {
+		return nil, err
+	}
+
+	// The changes live in the new image now, drop the temporary layer
+	if err := g.graphHandler.Delete(record.Layer); err != nil {
+		g.logger.Warnf("delete %s: %v", record.Layer, err)
+	}
+	if err := g.mountStore.Remove(record.MountPoint); err != nil {
+		return nil, err
+	}
+
+	return img, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/ioutils"
+)
+
+// compressionNames maps the --compress values to the archive compressions
+var compressionNames = map[string]archive.Compression{
+	"none":  archive.Uncompressed,
+	"gzip":  archive.Gzip,
+	"bzip2": archive.Bzip2,
+	"xz":    archive.Xz,
+}
+
+// compressionExtensions maps file extensions to the compression they imply
+var compressionExtensions = []struct {
+	ext         string
+	compression archive.Compression
+}{
+	{".tar.gz", archive.Gzip},
+	{".tgz", archive.Gzip},
+	{".tar.bz2", archive.Bzip2},
+	{".tbz2", archive.Bzip2},
+	{".tar.xz", archive.Xz},
+	{".txz", archive.Xz},
+}
+
+// parseCompression returns the compression named name, an empty name
+// guesses it from the extension of path
+func parseCompression(name string, path string) (archive.Compression, error) {
+	if name == "" {
+		for _, e := range compressionExtensions {
+			if strings.HasSuffix(path, e.ext) {
+				return e.compression, nil
+			}
+		}
+		return archive.Uncompressed, nil
+	}
+	compression, ok := compressionNames[name]
+	if !ok {
+		return archive.Uncompressed, fmt.Errorf("unknown compression %q, use gzip, bzip2, xz or none", name)
+	}
+	return compression, nil
+}
+
+// createOutput creates the file dst compressed with compression, "-" is stdout
+func createOutput(dst string, compression archive.Compression) (io.WriteCloser, error) {
+	var out io.WriteCloser = ioutils.NopWriteCloser(os.Stdout)
+	if dst != "-" {
+		f, err := os.Create(dst)
+		if err != nil {
+			return nil, err
+		}
+		out = f
+	}
+	w, err := compressWriter(out, compression)
+	if err != nil {
+		out.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// compressWriter returns a writer that compresses to dest, closing it closes dest.
+// archive.CompressStream only writes gzip, bzip2 and xz go through the
+// external tools like docker does to read them
+func compressWriter(dest io.WriteCloser, compression archive.Compression) (io.WriteCloser, error) {
+	switch compression {
+	case archive.Bzip2:
+		return cmdWriter(dest, "bzip2", "-c")
+	case archive.Xz:
+		return cmdWriter(dest, "xz", "-z", "-c", "-q")
+	}
+
+	stream, err := archive.CompressStream(dest, compression)
+	if err != nil {
+		return nil, err
+	}
+	return &compressedFile{stream, dest}, nil
+}
+
+// compressedFile closes the compressed stream and then the file it writes to
+type compressedFile struct {
+	io.WriteCloser
+	dest io.Closer
+}
+
+func (c *compressedFile) Close() error {
+	err := c.WriteCloser.Close()
+	if cerr := c.dest.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// compressCmd is the stdin of a running compression tool
+type compressCmd struct {
+	io.WriteCloser
+	cmd  *exec.Cmd
+	dest io.Closer
+}
+
+func cmdWriter(dest io.WriteCloser, name string, args ...string) (io.WriteCloser, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = dest
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return &compressCmd{stdin, cmd, dest}, nil
+}
+
+func (c *compressCmd) Close() error {
+	err := c.WriteCloser.Close()
+	if werr := c.cmd.Wait(); err == nil && werr != nil {
+		err = fmt.Errorf("%s: %v", c.cmd.Path, werr)
+	}
+	if cerr := c.dest.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
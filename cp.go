@@ -0,0 +1,271 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/parsers"
+)
+
+// splitImagePath splits an <image>:<path> argument of dg cp, ok is false for
+// a local path. The path starts at the first ":/" as tags and registry ports
+// can hold colons too
+func splitImagePath(arg string) (string, string, bool) {
+	if arg == "-" || strings.HasPrefix(arg, "/") || strings.HasPrefix(arg, ".") {
+		return "", "", false
+	}
+	if i := strings.Index(arg, ":/"); i > 0 {
+		return arg[:i], arg[i+1:], true
+	}
+	if i := strings.LastIndex(arg, ":"); i > 0 {
+		return arg[:i], "/" + arg[i+1:], true
+	}
+	return "", "", false
+}
+
+// (g *GraphTool) lookupImageFS opens the files of imageName
+func (g *GraphTool) lookupImageFS(imageName string) (*image.Image, *imageFS, error) {
+	img, err := g.LookupImage(imageName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if img == nil {
+		return nil, nil, fmt.Errorf("image %s not found", imageName)
+	}
+	fs, err := g.openImageFS(img)
+	if err != nil {
+		return nil, nil, err
+	}
+	return img, fs, nil
+}
+
+// (g *GraphTool) Cat writes the file name of imageName to stdout
+func (g *GraphTool) Cat(imageName string, name string) error {
+	_, fs, err := g.lookupImageFS(imageName)
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+
+	f, err := fs.open(name)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%s: no such file in %s", name, imageName)
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", name)
+	}
+	_, err = io.Copy(os.Stdout, f)
+	return err
+}
+
+// (g *GraphTool) Copy copies between an image and the host like docker cp,
+// one of src and dest is <image>:<path>. Copying to an image creates an image
+// with the files in a new layer, tagged repoTag when it is not empty
+func (g *GraphTool) Copy(src, dest, repoTag string) error {
+	srcImage, srcPath, fromImage := splitImagePath(src)
+	destImage, destPath, toImage := splitImagePath(dest)
+	switch {
+	case fromImage && toImage:
+		return fmt.Errorf("copying between images is not supported")
+	case fromImage:
+		if repoTag != "" {
+			return fmt.Errorf("--tag only applies when copying to an image")
+		}
+		return g.copyFromImage(srcImage, srcPath, dest)
+	case toImage:
+		img, err := g.copyToImage(src, destImage, destPath, repoTag)
+		if err != nil {
+			return err
+		}
+		fmt.Println(img.ID)
+		return nil
+	}
+	return fmt.Errorf("one of %s and %s must be <image>:<path>", src, dest)
+}
+
+// (g *GraphTool) copyFromImage extracts name and everything under it to
+// dest, a tar of them is written to stdout when dest is -
+func (g *GraphTool) copyFromImage(imageName, name, dest string) error {
+	_, fs, err := g.lookupImageFS(imageName)
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+
+	resolved, err := fs.resolve(name)
+	if err != nil {
+		return err
+	}
+	if resolved == "/" {
+		return fmt.Errorf("copy the whole image with dg bundle")
+	}
+	_, info, err := fs.lookup(resolved)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%s: no such file or directory in %s", name, imageName)
+	} else if err != nil {
+		return err
+	}
+
+	if dest == "-" {
+		tw := tar.NewWriter(os.Stdout)
+		if err := fs.tarTree(tw, resolved, filepath.Base(resolved)); err != nil {
+			return err
+		}
+		return tw.Close()
+	}
+
+	content, w := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(w)
+		err := fs.tarTree(tw, resolved, filepath.Base(resolved))
+		if err == nil {
+			err = tw.Close()
+		}
+		w.CloseWithError(err)
+	}()
+	srcInfo := archive.CopyInfo{
+		Path:   resolved,
+		Exists: true,
+		IsDir:  info.IsDir(),
+	}
+	err = archive.CopyTo(content, srcInfo, dest)
+	// Unblocks the writer when the copy stopped early
+	content.Close()
+	return err
+}
+
+// (g *GraphTool) copyToImage registers a layer with src copied to name on
+// top of imageName, tags it repoTag when it is not empty and returns it
+func (g *GraphTool) copyToImage(src, imageName, name, repoTag string) (*image.Image, error) {
+	unlock, err := g.lockGraph()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	src, err = filepath.Abs(src)
+	if err != nil {
+		return nil, err
+	}
+	srcInfo, err := archive.CopyInfoSourcePath(src)
+	if err != nil {
+		return nil, err
+	}
+
+	parent, fs, err := g.lookupImageFS(imageName)
+	if err != nil {
+		return nil, err
+	}
+	defer fs.Close()
+
+	// The destination is resolved in the image like CopyInfoDestinationPath
+	// does on the host, its parent has to exist
+	resolved, err := fs.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	dstInfo := archive.CopyInfo{Path: resolved}
+	if _, info, err := fs.lookup(resolved); err == nil {
+		dstInfo.Exists = true
+		dstInfo.IsDir = info.IsDir()
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	} else if _, info, err := fs.lookup(filepath.Dir(resolved)); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("%s: no such directory in %s", filepath.Dir(name), imageName)
+	}
+
+	content, err := archive.TarResource(srcInfo)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+	dstDir, copyArchive, err := archive.PrepareArchiveCopy(content, srcInfo, dstInfo)
+	if err != nil {
+		return nil, err
+	}
+	defer copyArchive.Close()
+
+	// The parents are in the layer with their attributes, the aufs branches
+	// would hide the lower ones otherwise
+	parents := []*tar.Header{}
+	for dir := dstDir; dir != "/"; dir = filepath.Dir(dir) {
+		path, info, err := fs.lookup(dir)
+		if err != nil {
+			return nil, err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		hdr.Name = strings.TrimPrefix(dir, "/") + "/"
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			hdr.Uid = int(stat.Uid)
+			hdr.Gid = int(stat.Gid)
+		}
+		parents = append([]*tar.Header{hdr}, parents...)
+	}
+
+	layer, w := io.Pipe()
+	go func() {
+		w.CloseWithError(rebaseTar(w, copyArchive, parents, strings.TrimPrefix(dstDir, "/")))
+	}()
+	defer layer.Close()
+
+	img, err := newChildImage(parent, "", parent.Config, fmt.Sprintf("dg cp %s in %s", filepath.Base(src), resolved))
+	if err != nil {
+		return nil, err
+	}
+	repo, tag := parsers.ParseRepositoryTag(repoTag)
+	if err := g.registerImage(img, layer, repo, tag); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// rebaseTar writes the headers of parents and then the entries of content
+// moved under dir to w
+func rebaseTar(w io.Writer, content io.Reader, parents []*tar.Header, dir string) error {
+	tw := tar.NewWriter(w)
+	for _, hdr := range parents {
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+	}
+	tr := tar.NewReader(content)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return tw.Close()
+		} else if err != nil {
+			return err
+		}
+		hdr.Name = filepath.Join(dir, hdr.Name)
+		if hdr.Typeflag == tar.TypeDir {
+			hdr.Name += "/"
+		}
+		if hdr.Typeflag == tar.TypeLink {
+			hdr.Linkname = filepath.Join(dir, hdr.Linkname)
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/image"
+)
+
+const (
+	defaultDockerRoot   = "/var/lib/docker"
+	defaultDaemonConfig = "/etc/docker/daemon.json"
+	defaultPidfile      = "/var/run/docker.pid"
+)
+
+// daemonEnvFiles are the distro files used to pass flags to dockerd
+var daemonEnvFiles = []string{
+	"/etc/default/docker",
+	"/etc/sysconfig/docker",
+	"/etc/sysconfig/docker-storage",
+}
+
+// daemonConfig holds the storage settings dockerd was configured with
+type daemonConfig struct {
+	Graph         string   `json:"graph"`
+	DataRoot      string   `json:"data-root"`
+	StorageDriver string   `json:"storage-driver"`
+	StorageOpts   []string `json:"storage-opts"`
+	Pidfile       string   `json:"pidfile"`
+}
+
+// root returns the docker root configured for the daemon or ""
+func (c *daemonConfig) root() string {
+	if c.DataRoot != "" {
+		return c.DataRoot
+	}
+	return c.Graph
+}
+
+// loadDaemonConfig reads the daemon storage settings from daemon.json
+// and from the flags in the distro env files, daemon.json wins
+func loadDaemonConfig(path string) *daemonConfig {
+	config := &daemonConfig{}
+	for _, envFile := range daemonEnvFiles {
+		parseDaemonEnvFile(envFile, config)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return config
+	}
+	defer f.Close()
+
+	fileConfig := &daemonConfig{}
+	if err := json.NewDecoder(f).Decode(fileConfig); err != nil {
+		return config
+	}
+	if fileConfig.root() != "" {
+		config.Graph, config.DataRoot = fileConfig.Graph, fileConfig.DataRoot
+	}
+	if fileConfig.StorageDriver != "" {
+		config.StorageDriver = fileConfig.StorageDriver
+	}
+	if len(fileConfig.StorageOpts) > 0 {
+		config.StorageOpts = fileConfig.StorageOpts
+	}
+	if fileConfig.Pidfile != "" {
+		config.Pidfile = fileConfig.Pidfile
+	}
+	return config
+}
+
+// parseDaemonEnvFile looks for -g/--graph, -s/--storage-driver, --storage-opt
+// and -p/--pidfile in the variables of a shell env file (e.g. DOCKER_OPTS)
+func parseDaemonEnvFile(path string, config *daemonConfig) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		args := strings.Fields(strings.Trim(kv[1], `"'`))
+		for i := 0; i < len(args); i++ {
+			name, value := args[i], ""
+			if parts := strings.SplitN(name, "=", 2); len(parts) == 2 {
+				name, value = parts[0], parts[1]
+			} else if i+1 < len(args) {
+				value = args[i+1]
+			}
+
+			switch name {
+			case "-g", "--graph", "--data-root":
+				config.Graph = value
+			case "-s", "--storage-driver":
+				config.StorageDriver = value
+			case "--storage-opt":
+				config.StorageOpts = append(config.StorageOpts, value)
+			case "-p", "--pidfile":
+				config.Pidfile = value
+			default:
+				continue
+			}
+			if !strings.Contains(args[i], "=") {
+				i++
+			}
+		}
+	}
+}
+
+// driverLayerDirs is where each driver keeps a directory or a file per
+// layer under the docker root, in the order dockerd prefers them
+var driverLayerDirs = []struct {
+	driver string
+	dir    string
+}{
+	{"aufs", "aufs/diff"},
+	{"btrfs", "btrfs/subvolumes"},
+	{"zfs", "zfs/graph"},
+	{"devicemapper", "devicemapper/metadata"},
+	{"overlay", "overlay"},
+	{"vfs", "vfs/dir"},
+}
+
+// priorDriver returns the first driver, in the dockerd priority order,
+// that has layers under root. dg writes repositories-<driver> and the driver
+// directory itself, so only the layers tell which driver dockerd used
+func priorDriver(root string) string {
+	for _, d := range driverLayerDirs {
+		entries, err := ioutil.ReadDir(filepath.Join(root, d.dir))
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if image.ValidateID(entry.Name()) == nil {
+				return d.driver
+			}
+		}
+	}
+	return ""
+}
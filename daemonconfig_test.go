@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPriorDriver(t *testing.T) {
+	root, err := ioutil.TempDir("", "dg-root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	id := strings.Repeat("ab", 32)
+	mkdir := func(path string) {
+		if err := os.MkdirAll(filepath.Join(root, path), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if driver := priorDriver(root); driver != "" {
+		t.Errorf("empty root: got %q", driver)
+	}
+
+	// dg itself leaves an empty driver directory and a repositories file
+	mkdir("aufs/diff")
+	mkdir("devicemapper/metadata")
+	if err := ioutil.WriteFile(filepath.Join(root, "devicemapper/metadata/deviceset-metadata"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "repositories-aufs"), []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mkdir("vfs/dir/" + id)
+	if driver := priorDriver(root); driver != "vfs" {
+		t.Errorf("got %q, want vfs", driver)
+	}
+
+	mkdir("overlay/" + id)
+	if driver := priorDriver(root); driver != "overlay" {
+		t.Errorf("got %q, want overlay", driver)
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/symlink"
+)
+
+// maxContentDiff is the size above which dg diff --content skips a file
+const maxContentDiff = 256 * 1024
+
+// FileStat is the metadata of a path on one side of dg diff
+type FileStat struct {
+	Size     int64     `json:"size"`
+	Mode     string    `json:"mode"`
+	Uid      int       `json:"uid"`
+	Gid      int       `json:"gid"`
+	Mtime    time.Time `json:"mtime"`
+	Linkname string    `json:"linkname,omitempty"`
+}
+
+// DiffEntry is a path added (A), changed (C) or deleted (D) between two images
+type DiffEntry struct {
+	Path      string    `json:"path"`
+	Kind      string    `json:"kind"`
+	Old       *FileStat `json:"old,omitempty"`
+	New       *FileStat `json:"new,omitempty"`
+	SizeDelta int64     `json:"size_delta"`
+	// Diff is the unified diff of small text files with --content
+	Diff string `json:"diff,omitempty"`
+}
+
+// byPath sorts changes by path
+type byPath []archive.Change
+
+func (c byPath) Len() int           { return len(c) }
+func (c byPath) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c byPath) Less(i, j int) bool { return c[i].Path < c[j].Path }
+
+// (g *GraphTool) Diff prints the paths that differ from oldName to newName.
+// When newName is empty oldName is compared to its parent. Parent and child
+// layers are compared by the storage driver, other images on read-only mounts.
+// format is table (docker diff), json (with the metadata of both sides) or a Go
+// template, content adds unified diffs of the small text files
+func (g *GraphTool) Diff(oldName, newName string, format string, content bool) error {
+	oldImg, err := g.LookupImage(oldName)
+	if err != nil {
+		return err
+	}
+	newImg := oldImg
+	if newName == "" {
+		if oldImg, err = g.graphHandler.GetParent(newImg); err != nil {
+			return err
+		}
+	} else if newImg, err = g.LookupImage(newName); err != nil {
+		return err
+	}
+
+	// Only the listing can be done without mounting
+	needViews := content || (format != "" && format != outputTable)
+	parentChild := (oldImg == nil && newImg.Parent == "") || (oldImg != nil && newImg.Parent == oldImg.ID)
+
+	var oldDir, newDir string
+	if needViews || !parentChild {
+		if oldImg != nil {
+			dir, cleanup, err := g.mountView(oldImg)
+			if err != nil {
+				return err
+			}
+			defer cleanup()
+			oldDir = dir
+		}
+		dir, cleanup, err := g.mountView(newImg)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		newDir = dir
+	}
+
+	var changes []archive.Change
+	if parentChild {
+		parent := ""
+		if oldImg != nil {
+			parent = oldImg.ID
+		}
+		changes, err = g.graphDriver.Changes(newImg.ID, parent)
+	} else {
+		// An empty oldDir compares newDir to nothing
+		changes, err = archive.ChangesDirs(newDir, oldDir)
+	}
+	if err != nil {
+		return err
+	}
+	sort.Sort(byPath(changes))
+
+	entries := make([]*DiffEntry, 0, len(changes))
+	for _, change := range changes {
+		entry := &DiffEntry{Path: change.Path}
+		switch change.Kind {
+		case archive.ChangeAdd:
+			entry.Kind = "A"
+		case archive.ChangeDelete:
+			entry.Kind = "D"
+		default:
+			entry.Kind = "C"
+		}
+		if needViews {
+			if err := entry.stat(oldDir, newDir); err != nil {
+				return err
+			}
+		}
+		if content {
+			if entry.Diff, err = contentDiff(entry, oldDir, newDir); err != nil {
+				return err
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	items := make([]interface{}, 0, len(entries))
+	for _, entry := range entries {
+		items = append(items, entry)
+	}
+	return printOutput(format, items, func(w *tabwriter.Writer) {
+		// Not aligned, the tabs of the diffs are content
+		for _, entry := range entries {
+			fmt.Fprintf(w, "%s %s\n", entry.Kind, entry.Path)
+			fmt.Fprint(w, escapeTabs(entry.Diff))
+		}
+	})
+}
+
+// escapeTabs escapes the tabs of text, w writes them as they are
+func escapeTabs(text string) string {
+	return strings.Replace(text, "\t", string([]byte{tabwriter.Escape, '\t', tabwriter.Escape}), -1)
+}
+
+// (g *GraphTool) mountView mounts img read-only on a temporary directory,
+// cleanup unmounts and removes it
+func (g *GraphTool) mountView(img *image.Image) (string, func(), error) {
+	tmpDir, err := ioutil.TempDir(os.TempDir(), "dg-view")
+	if err != nil {
+		return "", nil, err
+	}
+	if err := g.Mount(img.ID, tmpDir, []string{"ro", "nosuid", "nodev"}, mountReadOnly); err != nil {
+		os.RemoveAll(tmpDir)
+		return "", nil, err
+	}
+	return tmpDir, func() {
+		if err := g.Unmount(tmpDir, false); err != nil {
+			g.logger.Warnf("unmounting %s: %v", tmpDir, err)
+			return
+		}
+		os.Remove(tmpDir)
+	}, nil
+}
+
+// (e *DiffEntry) stat fills the metadata of both sides of the entry
+func (e *DiffEntry) stat(oldDir, newDir string) error {
+	var err error
+	if e.Kind != "A" && oldDir != "" {
+		if e.Old, err = statPath(oldDir, e.Path); err != nil {
+			return err
+		}
+	}
+	if e.Kind != "D" {
+		if e.New, err = statPath(newDir, e.Path); err != nil {
+			return err
+		}
+	}
+	if e.New != nil {
+		e.SizeDelta += e.New.Size
+	}
+	if e.Old != nil {
+		e.SizeDelta -= e.Old.Size
+	}
+	return nil
+}
+
+// statPath returns the metadata of name under root, nil when it doesn't exist
+func statPath(root, name string) (*FileStat, error) {
+	path := filepath.Join(root, name)
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	st := &FileStat{
+		Size:  info.Size(),
+		Mode:  info.Mode().String(),
+		Mtime: info.ModTime().UTC(),
+	}
+	if sys, ok := info.Sys().(*syscall.Stat_t); ok {
+		st.Uid = int(sys.Uid)
+		st.Gid = int(sys.Gid)
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		if st.Linkname, err = os.Readlink(path); err != nil {
+			return nil, err
+		}
+	}
+	return st, nil
+}
+
+// contentDiff returns the unified diff of the entry when both sides are
+// small text files, a missing side is compared as empty
+func contentDiff(e *DiffEntry, oldDir, newDir string) (string, error) {
+	oldFile, newFile := os.DevNull, os.DevNull
+	if e.Kind != "A" && oldDir != "" {
+		path, ok, err := textFile(oldDir, e.Path)
+		if err != nil || !ok {
+			return "", err
+		}
+		oldFile = path
+	}
+	if e.Kind != "D" {
+		path, ok, err := textFile(newDir, e.Path)
+		if err != nil || !ok {
+			return "", err
+		}
+		newFile = path
+	}
+	if oldFile == os.DevNull && newFile == os.DevNull {
+		return "", nil
+	}
+
+	diff, err := unifiedDiff("a"+e.Path, "b"+e.Path, oldFile, newFile)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", e.Path, err)
+	}
+	return diff, nil
+}
+
+// unifiedDiff returns the unified diff of the files oldFile and newFile, named
+// oldLabel and newLabel in it. It is empty when they are the same
+func unifiedDiff(oldLabel, newLabel, oldFile, newFile string) (string, error) {
+	var out bytes.Buffer
+	cmd := exec.Command("diff", "-u", "--label", oldLabel, "--label", newLabel, oldFile, newFile)
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		// diff exits with 1 when the files differ
+		if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.Sys().(syscall.WaitStatus).ExitStatus() != 1 {
+			return "", fmt.Errorf("diff: %v", err)
+		}
+	}
+	return out.String(), nil
+}
+
+// textFile returns the path of name under root when it is a regular text
+// file small enough to be diffed. Symlinks are resolved inside root
+func textFile(root, name string) (string, bool, error) {
+	path, err := symlink.FollowSymlinkInScope(filepath.Join(root, name), root)
+	if err != nil {
+		return "", false, err
+	}
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	if !info.Mode().IsRegular() || info.Size() > maxContentDiff {
+		return "", false, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", false, err
+	}
+	if bytes.IndexByte(data, 0) >= 0 || !utf8.Valid(data) {
+		return "", false, nil
+	}
+	return path, true, nil
+}
@@ -0,0 +1,8 @@
+// +build !exclude_graphdriver_aufs,linux
+
+package main
+
+import (
+	// register the aufs graphdriver
+	_ "github.com/docker/docker/daemon/graphdriver/aufs"
+)
@@ -0,0 +1,8 @@
+// +build !exclude_graphdriver_btrfs,linux
+
+package main
+
+import (
+	// register the btrfs graphdriver
+	_ "github.com/docker/docker/daemon/graphdriver/btrfs"
+)
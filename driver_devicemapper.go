@@ -0,0 +1,9 @@
+// +build graphdriver_devicemapper,!exclude_graphdriver_devicemapper,linux,cgo
+
+package main
+
+import (
+	// register the devicemapper graphdriver, it needs cgo, libdevmapper
+	// and github.com/docker/docker/pkg/devicemapper in the GOPATH
+	_ "github.com/docker/docker/daemon/graphdriver/devmapper"
+)
@@ -0,0 +1,8 @@
+// +build !exclude_graphdriver_overlay,linux
+
+package main
+
+import (
+	// register the overlay graphdriver
+	_ "github.com/docker/docker/daemon/graphdriver/overlay"
+)
@@ -0,0 +1,8 @@
+// +build !exclude_graphdriver_vfs,linux
+
+package main
+
+import (
+	// register the vfs graphdriver
+	_ "github.com/docker/docker/daemon/graphdriver/vfs"
+)
@@ -0,0 +1,9 @@
+// +build graphdriver_zfs,!exclude_graphdriver_zfs,linux
+
+package main
+
+import (
+	// register the zfs graphdriver, it needs github.com/mistifyio/go-zfs
+	// in the GOPATH and the zfs tools at runtime
+	_ "github.com/docker/docker/daemon/graphdriver/zfs"
+)
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/pkg/stringid"
+	"github.com/docker/docker/pkg/units"
+)
+
+// LayerUsage is the disk used by a layer and the images that hold it
+type LayerUsage struct {
+	ID       string `json:"id"`
+	ParentID string `json:"parent_id,omitempty"`
+	Size     int64  `json:"size"`
+	Refs     int    `json:"refs"`
+	// Images are the ids of the tagged images and dangling heads built on the layer
+	Images []string `json:"images"`
+}
+
+// ImageUsage splits the disk of an image between the layers only it holds
+// and the layers shared with other images
+type ImageUsage struct {
+	ID     string   `json:"id"`
+	Tags   []string `json:"tags"`
+	Size   int64    `json:"size"`
+	Unique int64    `json:"unique"`
+	Shared int64    `json:"shared"`
+	Layers int      `json:"layers"`
+}
+
+// RepoUsage is the disk of the images of a repository, Unique is what
+// deleting all of them frees
+type RepoUsage struct {
+	Repository string `json:"repository"`
+	Images     int    `json:"images"`
+	Size       int64  `json:"size"`
+	Unique     int64  `json:"unique"`
+	Shared     int64  `json:"shared"`
+}
+
+// DeleteUsage is what deleting a set of images would do: the tags removed,
+// the images deleted and the layers freed. Blocked are the names that can't
+// be removed, by what uses them
+type DeleteUsage struct {
+	Untagged []string          `json:"untagged"`
+	Deleted  []string          `json:"deleted"`
+	Blocked  map[string]string `json:"blocked"`
+	Layers   []string          `json:"layers"`
+	Freed    int64             `json:"freed"`
+}
+
+// diskUsage is the graph with the size of every layer
+type diskUsage struct {
+	all      map[string]*image.Image
+	byParent map[string][]*image.Image
+	heads    map[string]*image.Image
+	tags     map[string][]string
+	sizes    map[string]int64
+}
+
+// (g *GraphTool) diskUsage measures every layer of the graph with the driver
+func (g *GraphTool) diskUsage() *diskUsage {
+	du := &diskUsage{
+		all:      g.graphHandler.Map(),
+		byParent: g.graphHandler.ByParent(),
+		heads:    g.graphHandler.Heads(),
+		tags:     g.tagStore.ByID(),
+		sizes:    map[string]int64{},
+	}
+	for id, img := range du.all {
+		size, err := g.graphDriver.DiffSize(id, img.Parent)
+		if err != nil {
+			g.logger.Warnf("measuring %s: %v, using the recorded size", stringid.TruncateID(id), err)
+			size = img.Size
+		}
+		du.sizes[id] = size
+	}
+	return du
+}
+
+// (du *diskUsage) roots returns the images that hold layers: the tagged
+// images and the heads, the untagged heads are dangling images
+func (du *diskUsage) roots(tags map[string][]string) map[string]bool {
+	roots := map[string]bool{}
+	for id := range du.heads {
+		roots[id] = true
+	}
+	for id, refs := range tags {
+		if _, ok := du.all[id]; ok && len(refs) > 0 {
+			roots[id] = true
+		}
+	}
+	return roots
+}
+
+// (du *diskUsage) refs returns the roots built on each layer, the layers no
+// root is built on are left out
+func (du *diskUsage) refs(roots map[string]bool) map[string][]string {
+	refs := map[string][]string{}
+	var walk func(img *image.Image) []string
+	walk = func(img *image.Image) []string {
+		held := []string{}
+		if roots[img.ID] {
+			held = append(held, img.ID)
+		}
+		for _, child := range du.byParent[img.ID] {
+			held = append(held, walk(child)...)
+		}
+		if len(held) > 0 {
+			sort.Strings(held)
+			refs[img.ID] = held
+		}
+		return held
+	}
+	for _, img := range du.all {
+		if _, ok := du.all[img.Parent]; img.Parent == "" || !ok {
+			walk(img)
+		}
+	}
+	return refs
+}
+
+// (du *diskUsage) layers returns the layers of id, top first
+func (du *diskUsage) layers(id string) []string {
+	layers := []string{}
+	for img, ok := du.all[id]; ok; img, ok = du.all[img.Parent] {
+		layers = append(layers, img.ID)
+	}
+	return layers
+}
+
+// (du *diskUsage) images returns the usage of each root, largest unique first
+func (du *diskUsage) images(refs map[string][]string) []*ImageUsage {
+	usages := []*ImageUsage{}
+	for id := range du.roots(du.tags) {
+		tags := du.tags[id]
+		if tags == nil {
+			tags = []string{}
+		}
+		usage := &ImageUsage{ID: id, Tags: tags}
+		for _, layer := range du.layers(id) {
+			usage.Size += du.sizes[layer]
+			usage.Layers++
+			if len(refs[layer]) > 1 {
+				usage.Shared += du.sizes[layer]
+			} else {
+				usage.Unique += du.sizes[layer]
+			}
+		}
+		usages = append(usages, usage)
+	}
+	sort.Sort(byUnique(usages))
+	return usages
+}
+
+// (du *diskUsage) repositories rolls the images up per repository, a layer
+// is unique to a repository when all the images built on it belong to it.
+// Dangling images make up the <none> repository
+func (du *diskUsage) repositories(refs map[string][]string) []*RepoUsage {
+	repoImages := map[string]map[string]bool{}
+	for id := range du.roots(du.tags) {
+		names := map[string]bool{}
+		for _, ref := range du.tags[id] {
+			names[repositoryName(ref)] = true
+		}
+		if len(names) == 0 {
+			names["<none>"] = true
+		}
+		for name := range names {
+			if repoImages[name] == nil {
+				repoImages[name] = map[string]bool{}
+			}
+			repoImages[name][id] = true
+		}
+	}
+
+	usages := []*RepoUsage{}
+	for name, images := range repoImages {
+		usage := &RepoUsage{Repository: name, Images: len(images)}
+		seen := map[string]bool{}
+		for id := range images {
+			for _, layer := range du.layers(id) {
+				if seen[layer] {
+					continue
+				}
+				seen[layer] = true
+				usage.Size += du.sizes[layer]
+				unique := true
+				for _, holder := range refs[layer] {
+					if !images[holder] {
+						unique = false
+						break
+					}
+				}
+				if unique {
+					usage.Unique += du.sizes[layer]
+				} else {
+					usage.Shared += du.sizes[layer]
+				}
+			}
+		}
+		usages = append(usages, usage)
+	}
+	sort.Sort(byRepoUnique(usages))
+	return usages
+}
+
+// repositoryName returns the repository of a repo:tag or repo@digest reference
+func repositoryName(ref string) string {
+	if i := strings.Index(ref, "@"); i >= 0 {
+		return ref[:i]
+	}
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		return ref[:i]
+	}
+	return ref
+}
+
+// (g *GraphTool) simulateDelete works out what dg rmi --force would do with
+// names without touching the graph, the freed size comes from du
+func (g *GraphTool) simulateDelete(du *diskUsage, names []string) (*DeleteUsage, error) {
+	result := &DeleteUsage{Untagged: []string{}, Deleted: []string{}, Blocked: map[string]string{}, Layers: []string{}}
+	state, err := g.newRmiState(func(action, name string) {
+		switch action {
+		case "Untagged":
+			result.Untagged = append(result.Untagged, name)
+		case "Deleted":
+			result.Layers = append(result.Layers, name)
+			result.Freed += du.sizes[name]
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	named := map[string]bool{}
+	for _, name := range names {
+		img, err := g.LookupImage(name)
+		if err != nil {
+			return nil, err
+		}
+		if img != nil {
+			named[img.ID] = true
+		}
+		if err := g.removeImage(name, true, true, state); err != nil {
+			inUse, ok := err.(*imageInUseError)
+			if !ok {
+				return nil, err
+			}
+			result.Blocked[name] = inUse.reason
+		}
+	}
+	// The images with children stay, only untagged
+	for id := range named {
+		if state.deleted[id] {
+			result.Deleted = append(result.Deleted, id)
+		}
+	}
+	sort.Strings(result.Untagged)
+	sort.Strings(result.Deleted)
+	sort.Strings(result.Layers)
+	return result, nil
+}
+
+// (g *GraphTool) DiskUsage prints the disk used per image, per repository
+// (repos) or per layer (layers). With deletes it prints what deleting those
+// images would free instead. format is table, json or a Go template
+func (g *GraphTool) DiskUsage(repos, layers bool, deletes []string, format string) error {
+	du := g.diskUsage()
+
+	if len(deletes) > 0 {
+		result, err := g.simulateDelete(du, deletes)
+		if err != nil {
+			return err
+		}
+		return printOutput(format, []interface{}{result}, func(w *tabwriter.Writer) {
+			for _, ref := range result.Untagged {
+				fmt.Fprintf(w, "Untagged: %s\n", ref)
+			}
+			for _, id := range result.Deleted {
+				fmt.Fprintf(w, "Deleted: %s\n", id)
+			}
+			blocked := []string{}
+			for name := range result.Blocked {
+				blocked = append(blocked, name)
+			}
+			sort.Strings(blocked)
+			for _, name := range blocked {
+				fmt.Fprintf(w, "Blocked: %s is used by %s\n", name, result.Blocked[name])
+			}
+			fmt.Fprintf(w, "Would free %s in %d layers\n", units.HumanSize(float64(result.Freed)), len(result.Layers))
+		})
+	}
+
+	refs := du.refs(du.roots(du.tags))
+	items := []interface{}{}
+
+	switch {
+	case layers:
+		usages := []*LayerUsage{}
+		for id, img := range du.all {
+			images := refs[id]
+			if images == nil {
+				images = []string{}
+			}
+			usages = append(usages, &LayerUsage{
+				ID:       id,
+				ParentID: img.Parent,
+				Size:     du.sizes[id],
+				Refs:     len(images),
+				Images:   images,
+			})
+		}
+		sort.Sort(bySize(usages))
+		for _, usage := range usages {
+			items = append(items, usage)
+		}
+		return printOutput(format, items, func(w *tabwriter.Writer) {
+			fmt.Fprintln(w, "LAYER ID\tPARENT\tSIZE\tREFS")
+			for _, usage := range usages {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%d\n",
+					stringid.TruncateID(usage.ID),
+					stringid.TruncateID(usage.ParentID),
+					units.HumanSize(float64(usage.Size)),
+					usage.Refs,
+				)
+			}
+		})
+	case repos:
+		usages := du.repositories(refs)
+		for _, usage := range usages {
+			items = append(items, usage)
+		}
+		return printOutput(format, items, func(w *tabwriter.Writer) {
+			fmt.Fprintln(w, "REPOSITORY\tIMAGES\tSIZE\tUNIQUE\tSHARED")
+			for _, usage := range usages {
+				fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n",
+					usage.Repository,
+					usage.Images,
+					units.HumanSize(float64(usage.Size)),
+					units.HumanSize(float64(usage.Unique)),
+					units.HumanSize(float64(usage.Shared)),
+				)
+			}
+		})
+	}
+
+	usages := du.images(refs)
+	var total int64
+	for _, size := range du.sizes {
+		total += size
+	}
+	for _, usage := range usages {
+		items = append(items, usage)
+	}
+	return printOutput(format, items, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "IMAGE ID\tTAGS\tSIZE\tUNIQUE\tSHARED")
+		for _, usage := range usages {
+			tags := "<none>"
+			if len(usage.Tags) > 0 {
+				tags = strings.Join(usage.Tags, ", ")
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+				stringid.TruncateID(usage.ID),
+				tags,
+				units.HumanSize(float64(usage.Size)),
+				units.HumanSize(float64(usage.Unique)),
+				units.HumanSize(float64(usage.Shared)),
+			)
+		}
+		fmt.Fprintf(w, "TOTAL\t%d layers\t%s\t\t\n", len(du.sizes), units.HumanSize(float64(total)))
+	})
+}
+
+// byUnique sorts image usages by unique size, largest first
+type byUnique []*ImageUsage
+
+func (r byUnique) Len() int      { return len(r) }
+func (r byUnique) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r byUnique) Less(i, j int) bool {
+	if r[i].Unique == r[j].Unique {
+		return r[i].ID < r[j].ID
+	}
+	return r[i].Unique > r[j].Unique
+}
+
+// byRepoUnique sorts repository usages by unique size, largest first
+type byRepoUnique []*RepoUsage
+
+func (r byRepoUnique) Len() int      { return len(r) }
+func (r byRepoUnique) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r byRepoUnique) Less(i, j int) bool {
+	if r[i].Unique == r[j].Unique {
+		return r[i].Repository < r[j].Repository
+	}
+	return r[i].Unique > r[j].Unique
+}
+
+// bySize sorts layer usages by size, largest first
+type bySize []*LayerUsage
+
+func (r bySize) Len() int      { return len(r) }
+func (r bySize) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r bySize) Less(i, j int) bool {
+	if r[i].Size == r[j].Size {
+		return r[i].ID < r[j].ID
+	}
+	return r[i].Size > r[j].Size
+}
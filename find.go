@@ -0,0 +1,231 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/fileutils"
+	"github.com/docker/docker/pkg/stringid"
+)
+
+// What a layer did to a path, for dg find
+const (
+	findCreated     = "created"
+	findOverwritten = "overwritten"
+	findChmod       = "chmod"
+	findChown       = "chown"
+	findModified    = "modified"
+	findDeleted     = "deleted"
+)
+
+// FindRow is a layer that touched a path matching the dg find patterns
+type FindRow struct {
+	Path      string    `json:"path"`
+	Action    string    `json:"action"`
+	Layer     string    `json:"layer"`
+	Created   time.Time `json:"created"`
+	CreatedBy string    `json:"created_by"`
+}
+
+// entryState is what a layer tar says about a path, enough to tell a new
+// content from a metadata change
+type entryState struct {
+	mode     int64
+	uid, gid int
+	size     int64
+	linkname string
+	sum      [sha256.Size]byte
+}
+
+// (g *GraphTool) Find walks the layers of imageName from the base and prints
+// each layer that created, overwrote, chmod'ed, chown'ed or deleted a path
+// matching patterns, which are fileutils patterns like the .dockerignore ones.
+// The changes of each layer come from the storage driver, the layer tar is
+// only read to tell an overwrite from a chmod
+func (g *GraphTool) Find(imageName string, patterns []string, format string) error {
+	patterns, patDirs, _, err := fileutils.CleanPatterns(trimSlashes(patterns))
+	if err != nil {
+		return err
+	}
+	if len(patterns) == 0 {
+		return fmt.Errorf("no pattern to find")
+	}
+
+	img, err := g.LookupImage(imageName)
+	if err != nil {
+		return err
+	}
+	if img == nil {
+		return fmt.Errorf("image %s not found", imageName)
+	}
+	history, err := g.imageHistory(img)
+	if err != nil {
+		return err
+	}
+
+	rows := []*FindRow{}
+	states := map[string]*entryState{}
+	for i := len(history) - 1; i >= 0; i-- {
+		layer := history[i]
+		changes, err := g.graphDriver.Changes(layer.ID, layer.Parent)
+		if err != nil {
+			return fmt.Errorf("changes of %s: %v", stringid.TruncateID(layer.ID), err)
+		}
+
+		matched := map[string]archive.ChangeType{}
+		for _, change := range changes {
+			ok, err := fileutils.OptimizedMatches(strings.TrimPrefix(change.Path, "/"), patterns, patDirs)
+			if err != nil {
+				return err
+			}
+			if ok {
+				matched[change.Path] = change.Kind
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+
+		layerStates, err := g.layerStates(layer, matched)
+		if err != nil {
+			return err
+		}
+		for _, name := range sortedKeys(matched) {
+			var action string
+			switch matched[name] {
+			case archive.ChangeAdd:
+				action = findCreated
+			case archive.ChangeDelete:
+				action = findDeleted
+			default:
+				action = modifyAction(states[name], layerStates[name])
+			}
+			if action == findDeleted {
+				delete(states, name)
+			} else if layerStates[name] != nil {
+				states[name] = layerStates[name]
+			}
+			rows = append(rows, &FindRow{
+				Path:      name,
+				Action:    action,
+				Layer:     layer.ID,
+				Created:   layer.Created.UTC(),
+				CreatedBy: createdBy(layer),
+			})
+		}
+	}
+
+	items := make([]interface{}, 0, len(rows))
+	for _, row := range rows {
+		items = append(items, row)
+	}
+	return printOutput(format, items, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "PATH\tACTION\tLAYER\tCREATED BY")
+		for _, row := range rows {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n",
+				row.Path,
+				row.Action,
+				stringid.TruncateID(row.Layer),
+				truncateCmd(row.CreatedBy, 45),
+			)
+		}
+	})
+}
+
+// (g *GraphTool) layerStates reads the entries of names from the layer tar
+func (g *GraphTool) layerStates(layer *image.Image, names map[string]archive.ChangeType) (map[string]*entryState, error) {
+	rdr, err := g.layerTar(layer)
+	if err != nil {
+		return nil, err
+	}
+	defer rdr.Close()
+
+	states := map[string]*entryState{}
+	tr := tar.NewReader(rdr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return states, nil
+		} else if err != nil {
+			return nil, err
+		}
+		name := path.Clean("/" + hdr.Name)
+		if _, ok := names[name]; !ok {
+			continue
+		}
+		state := &entryState{
+			mode:     hdr.Mode,
+			uid:      hdr.Uid,
+			gid:      hdr.Gid,
+			size:     hdr.Size,
+			linkname: hdr.Linkname,
+		}
+		if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA {
+			h := sha256.New()
+			if _, err := io.Copy(h, tr); err != nil {
+				return nil, err
+			}
+			copy(state.sum[:], h.Sum(nil))
+		}
+		states[name] = state
+	}
+}
+
+// modifyAction tells what a modification did from the states of the path
+// before and in the layer
+func modifyAction(before, after *entryState) string {
+	if before == nil || after == nil {
+		return findModified
+	}
+	switch {
+	case before.size != after.size || before.sum != after.sum || before.linkname != after.linkname:
+		return findOverwritten
+	case before.mode != after.mode:
+		return findChmod
+	case before.uid != after.uid || before.gid != after.gid:
+		return findChown
+	}
+	// Only the mtime or the content of a directory changed
+	return findModified
+}
+
+// createdBy returns the command of the container that created layer
+func createdBy(layer *image.Image) string {
+	if layer.ContainerConfig.Cmd == nil {
+		return ""
+	}
+	return strings.Join(layer.ContainerConfig.Cmd.Slice(), " ")
+}
+
+// trimSlashes makes absolute patterns relative, paths are matched without
+// their leading slash
+func trimSlashes(patterns []string) []string {
+	trimmed := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, "!") {
+			trimmed = append(trimmed, "!"+strings.TrimLeft(pattern[1:], "/"))
+		} else {
+			trimmed = append(trimmed, strings.TrimLeft(pattern, "/"))
+		}
+	}
+	return trimmed
+}
+
+// sortedKeys returns the paths of changes in order
+func sortedKeys(changes map[string]archive.ChangeType) []string {
+	keys := make([]string, 0, len(changes))
+	for key := range changes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -1,26 +1,63 @@
 package main
 
 import (
+	"io"
+	"os"
+	"path/filepath"
+
 	"github.com/Sirupsen/logrus"
 
 	"github.com/docker/docker/daemon/graphdriver"
-	_ "github.com/docker/docker/daemon/graphdriver/aufs"
-	_ "github.com/docker/docker/daemon/graphdriver/overlay"
 	"github.com/docker/docker/graph"
 	"github.com/docker/docker/image"
 )
 
 type GraphTool struct {
-	DockerRoot   string
-	graphDriver  graphdriver.Driver
-	graphHandler *graph.Graph
-	logger       *logrus.Logger
+	DockerRoot    string
+	StorageDriver string
+	StorageOpts   []string
+	NoMount       bool
+	graphDriver   graphdriver.Driver
+	graphHandler  *graph.Graph
+	tagStore      *graph.TagStore
+	mountStore    *MountStore
+	logger        *logrus.Logger
+	// pidfile is the one of dockerd, dg refuses to change the graph while it runs
+	pidfile string
 }
 
-// NewGraphTool create new graphtool handler
-func NewGraphTool(dockerRoot string) *GraphTool {
+// NewGraphTool create new graphtool handler, empty settings are
+// taken from the daemon configuration, the storage driver is detected
+// when the driver is initialized
+func NewGraphTool(dockerRoot string, storageDriver string, storageOpts []string) *GraphTool {
+	configPath := os.Getenv("DG_DAEMON_CONFIG")
+	if configPath == "" {
+		configPath = defaultDaemonConfig
+	}
+	config := loadDaemonConfig(configPath)
+
+	if dockerRoot == "" {
+		dockerRoot = config.root()
+	}
+	if dockerRoot == "" {
+		dockerRoot = defaultDockerRoot
+	}
+	if len(storageOpts) == 0 && (storageDriver == "" || storageDriver == config.StorageDriver) {
+		storageOpts = config.StorageOpts
+	}
+	if storageDriver == "" {
+		storageDriver = config.StorageDriver
+	}
+	pidfile := config.Pidfile
+	if pidfile == "" {
+		pidfile = defaultPidfile
+	}
+
 	return &GraphTool{
-		DockerRoot: dockerRoot,
+		DockerRoot:    dockerRoot,
+		StorageDriver: storageDriver,
+		StorageOpts:   storageOpts,
+		pidfile:       pidfile,
 		logger: logrus.WithFields(
 			logrus.Fields{
 				"docker_root": dockerRoot,
@@ -32,29 +69,55 @@ func NewGraphTool(dockerRoot string) *GraphTool {
 // initDriver ...
 func (g *GraphTool) InitDriver() error {
 	var err error
-	g.graphDriver, err = graphdriver.New(g.DockerRoot, make([]string, 0))
+	if g.StorageDriver == "" {
+		g.StorageDriver = priorDriver(g.DockerRoot)
+	}
+	if g.NoMount && g.StorageDriver == "aufs" {
+		// The aufs driver init remounts its root, the layers can be read without it
+		g.graphDriver = newAufsLayers(g.DockerRoot)
+	} else if g.StorageDriver != "" {
+		g.graphDriver, err = graphdriver.GetDriver(g.StorageDriver, g.DockerRoot, g.StorageOpts)
+	} else {
+		g.graphDriver, err = graphdriver.New(g.DockerRoot, g.StorageOpts)
+	}
 	if err != nil {
 		return err
 	}
+	g.logger.Debugf("using storage driver %s", g.graphDriver)
 	g.graphHandler, err = graph.NewGraph(g.DockerRoot+"/graph", g.graphDriver)
 	if err != nil {
 		return err
 	}
+	g.tagStore, err = graph.NewTagStore(g.DockerRoot+"/repositories-"+g.graphDriver.String(), &graph.TagStoreConfig{
+		Graph: g.graphHandler,
+	})
+	if err != nil {
+		return err
+	}
+	g.mountStore, err = NewMountStore(filepath.Join(g.DockerRoot, "graphtool", "mounts.json"))
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
 // lookupImage ...
 func (g *GraphTool) LookupImage(imageName string) (*image.Image, error) {
-	tagCfg := &graph.TagStoreConfig{
-		Graph: g.graphHandler,
-	}
-	tagStore, err := graph.NewTagStore(g.DockerRoot+"/repositories-"+g.graphDriver.String(), tagCfg)
-	if err != nil {
-		return nil, err
-	}
-	image, err := tagStore.LookupImage(imageName)
+	image, err := g.tagStore.LookupImage(imageName)
 	if err != nil {
 		return nil, err
 	}
 	return image, err
 }
+
+// (g *GraphTool) registerImage registers img with layer, nil for an empty
+// layer, and tags it repo:tag when repo is not empty
+func (g *GraphTool) registerImage(img *image.Image, layer io.Reader, repo, tag string) error {
+	if err := g.graphHandler.Register(img, layer); err != nil {
+		return err
+	}
+	if repo == "" {
+		return nil
+	}
+	return g.tagStore.Tag(repo, tag, img.ID, true)
+}
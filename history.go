@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/pkg/stringid"
+	"github.com/docker/docker/pkg/truncindex"
+	"github.com/docker/docker/pkg/units"
+)
+
+// (g *GraphTool) imageHistory returns the lineage of an image, starting
+// with the image itself, index 0 is the image top
+func (g *GraphTool) imageHistory(img *image.Image) ([]*image.Image, error) {
+	history := []*image.Image{}
+	err := g.graphHandler.WalkHistory(img, func(layer image.Image) error {
+		history = append(history, &layer)
+		return nil
+	})
+	return history, err
+}
+
+// (g *GraphTool) ResolveLayer returns the layer of imageName selected
+// either by a (prefix of a) layer id or by its position in the history
+func (g *GraphTool) ResolveLayer(imageName string, layer string, historyIndex int) (*image.Image, error) {
+	img, err := g.LookupImage(imageName)
+	if err != nil {
+		return nil, err
+	}
+
+	if layer == "" {
+		if historyIndex < 0 {
+			return nil, fmt.Errorf("invalid history index %d", historyIndex)
+		}
+		current := img
+		for i := 0; i < historyIndex; i++ {
+			if current, err = g.graphHandler.GetParent(current); err != nil {
+				return nil, err
+			}
+			if current == nil {
+				return nil, fmt.Errorf("history index %d is out of range for %s", historyIndex, imageName)
+			}
+		}
+		return current, nil
+	}
+
+	history, err := g.imageHistory(img)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(history))
+	for _, h := range history {
+		ids = append(ids, h.ID)
+	}
+	id, err := truncindex.NewTruncIndex(ids).Get(layer)
+	if err != nil {
+		return nil, fmt.Errorf("layer %s of %s: %v", layer, imageName, err)
+	}
+	return g.graphHandler.Get(id)
+}
+
+// (g *GraphTool) historyLayer returns the layer of history selected by name,
+// either a layer id (prefix) or the name of an image of the history
+func (g *GraphTool) historyLayer(imageName string, history []*image.Image, name string) (*image.Image, error) {
+	if layer, err := g.ResolveLayer(imageName, name, 0); err == nil {
+		return layer, nil
+	}
+	layer, err := g.LookupImage(name)
+	if err != nil {
+		return nil, err
+	}
+	if layer == nil {
+		return nil, fmt.Errorf("image %s not found", name)
+	}
+	for _, h := range history {
+		if h.ID == layer.ID {
+			return layer, nil
+		}
+	}
+	return nil, fmt.Errorf("%s is not a layer of %s", name, imageName)
+}
+
+// HistoryRow is a layer of dg history
+type HistoryRow struct {
+	Index     int       `json:"index"`
+	ID        string    `json:"id"`
+	Created   time.Time `json:"created"`
+	CreatedBy string    `json:"created_by"`
+	Size      int64     `json:"size"`
+	Tags      []string  `json:"tags"`
+	Comment   string    `json:"comment,omitempty"`
+}
+
+// (g *GraphTool) History prints the layers of an image with the index and
+// id accepted by mount --history-index and --layer, the command that created
+// them, their size and tags. format is table, json or a Go template
+func (g *GraphTool) History(imageName string, format string) error {
+	history, err := g.tagStore.History(imageName)
+	if err != nil {
+		return err
+	}
+
+	items := make([]interface{}, 0, len(history))
+	rows := make([]*HistoryRow, 0, len(history))
+	for i, layer := range history {
+		tags := layer.Tags
+		if tags == nil {
+			tags = []string{}
+		}
+		sort.Strings(tags)
+		row := &HistoryRow{
+			Index:     i,
+			ID:        layer.ID,
+			Created:   time.Unix(layer.Created, 0).UTC(),
+			CreatedBy: layer.CreatedBy,
+			Size:      layer.Size,
+			Tags:      tags,
+			Comment:   layer.Comment,
+		}
+		rows = append(rows, row)
+		items = append(items, row)
+	}
+
+	return printOutput(format, items, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "INDEX\tID\tCREATED\tCREATED BY\tSIZE\tTAGS")
+		for _, row := range rows {
+			fmt.Fprintf(w, "%d\t%s\t%s ago\t%s\t%s\t%s\n",
+				row.Index,
+				stringid.TruncateID(row.ID),
+				units.HumanDuration(time.Now().UTC().Sub(row.Created)),
+				truncateCmd(row.CreatedBy, 45),
+				units.HumanSize(float64(row.Size)),
+				strings.Join(row.Tags, ", "),
+			)
+		}
+	})
+}
+
+// truncateCmd shortens a command to max characters for the tables
+func truncateCmd(cmd string, max int) string {
+	cmd = strings.Replace(cmd, "\t", " ", -1)
+	if len(cmd) <= max {
+		return cmd
+	}
+	return cmd[:max-3] + "..."
+}
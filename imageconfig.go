@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/pkg/nat"
+	"github.com/docker/docker/pkg/parsers"
+	"github.com/docker/docker/pkg/stringutils"
+	"github.com/docker/docker/runconfig"
+)
+
+// ConfigOptions are the edits dg config makes to an image config, the empty
+// ones leave it as it is
+type ConfigOptions struct {
+	// Env sets KEY=VALUE variables, UnsetEnv removes variables by name
+	Env      []string
+	UnsetEnv []string
+	// Cmd and Entrypoint take the json or the shell form, [] clears them
+	Cmd        string
+	Entrypoint string
+	// Labels sets key=value labels
+	Labels  []string
+	WorkDir string
+	User    string
+	// Expose adds ports like EXPOSE, port[/proto] or a range
+	Expose []string
+	// Volumes adds volumes like VOLUME
+	Volumes []string
+}
+
+// (g *GraphTool) EditConfig creates an image with an empty layer on top of
+// imageName whose config is the one of imageName with options applied, and
+// tags it as repoTag. The changes of the config json are written to stderr
+// as a unified diff
+func (g *GraphTool) EditConfig(imageName, repoTag string, options *ConfigOptions) (*image.Image, error) {
+	repo, tag := parsers.ParseRepositoryTag(repoTag)
+	if repo == "" {
+		return nil, fmt.Errorf("invalid repository name %q", repoTag)
+	}
+	unlock, err := g.lockGraph()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	parent, err := g.LookupImage(imageName)
+	if err != nil {
+		return nil, err
+	}
+	if parent == nil {
+		return nil, fmt.Errorf("image %s not found", imageName)
+	}
+
+	config, err := copyConfig(parent.Config)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyConfigOptions(config, options); err != nil {
+		return nil, err
+	}
+
+	before, err := json.MarshalIndent(parent.Config, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	after, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(before, after) {
+		return nil, fmt.Errorf("the config of %s is unchanged", imageName)
+	}
+	diff, err := configDiff(before, after)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprint(os.Stderr, diff)
+
+	img, err := newChildImage(parent, "", config, "dg config")
+	if err != nil {
+		return nil, err
+	}
+	img.Author = parent.Author
+	// No layer data, like the config only steps of docker build
+	if err := g.registerImage(img, nil, repo, tag); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// applyConfigOptions applies options to config, the entrypoint goes before
+// the cmd as a new entrypoint resets the cmd
+func applyConfigOptions(config *runconfig.Config, options *ConfigOptions) error {
+	for _, name := range options.UnsetEnv {
+		env := []string{}
+		for _, e := range config.Env {
+			if strings.SplitN(e, "=", 2)[0] != name {
+				env = append(env, e)
+			}
+		}
+		config.Env = env
+	}
+	for _, e := range options.Env {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return fmt.Errorf("invalid env %q, expected KEY=VALUE", e)
+		}
+		config.Env = setEnv(config.Env, kv[0], kv[1])
+	}
+
+	if options.Entrypoint != "" {
+		entrypoint, err := parseCommand(options.Entrypoint)
+		if err != nil {
+			return fmt.Errorf("entrypoint: %v", err)
+		}
+		config.Entrypoint = stringutils.NewStrSlice(entrypoint...)
+		if len(entrypoint) == 0 {
+			config.Entrypoint = nil
+		}
+		config.Cmd = nil
+	}
+	if options.Cmd != "" {
+		cmd, err := parseCommand(options.Cmd)
+		if err != nil {
+			return fmt.Errorf("cmd: %v", err)
+		}
+		config.Cmd = stringutils.NewStrSlice(cmd...)
+		if len(cmd) == 0 {
+			config.Cmd = nil
+		}
+	}
+
+	for _, label := range options.Labels {
+		kv := strings.SplitN(label, "=", 2)
+		if kv[0] == "" {
+			return fmt.Errorf("invalid label %q, expected key=value", label)
+		}
+		if config.Labels == nil {
+			config.Labels = make(map[string]string)
+		}
+		if len(kv) == 1 {
+			kv = append(kv, "")
+		}
+		config.Labels[kv[0]] = kv[1]
+	}
+
+	if options.WorkDir != "" {
+		workdir := options.WorkDir
+		if !filepath.IsAbs(workdir) {
+			workdir = filepath.Join("/", config.WorkingDir, workdir)
+		}
+		config.WorkingDir = filepath.Clean(workdir)
+	}
+	if options.User != "" {
+		config.User = options.User
+	}
+
+	if len(options.Expose) > 0 {
+		ports, _, err := nat.ParsePortSpecs(options.Expose)
+		if err != nil {
+			return fmt.Errorf("expose: %v", err)
+		}
+		if config.ExposedPorts == nil {
+			config.ExposedPorts = make(map[nat.Port]struct{})
+		}
+		for port := range ports {
+			config.ExposedPorts[port] = struct{}{}
+		}
+	}
+	for _, volume := range options.Volumes {
+		if !filepath.IsAbs(volume) {
+			return fmt.Errorf("volume %s is not an absolute path", volume)
+		}
+		if config.Volumes == nil {
+			config.Volumes = make(map[string]struct{})
+		}
+		config.Volumes[filepath.Clean(volume)] = struct{}{}
+	}
+	return nil
+}
+
+// configDiff returns the unified diff of the before and after config json
+func configDiff(before, after []byte) (string, error) {
+	tmpDir, err := ioutil.TempDir(os.TempDir(), "dg-config")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpDir)
+	beforeFile, afterFile := filepath.Join(tmpDir, "before"), filepath.Join(tmpDir, "after")
+	if err := ioutil.WriteFile(beforeFile, append(before, '\n'), 0600); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(afterFile, append(after, '\n'), 0600); err != nil {
+		return "", err
+	}
+
+	return unifiedDiff("before", "after", beforeFile, afterFile)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/docker/docker/image"
+)
+
+// imageFS reads the files of an image without mounting it. The aufs layers
+// are read from their diff directories and an overlay image from its root, or
+// its upper and lower directories, top first with the whiteouts applied. The
+// other drivers hand out a directory with the whole image
+type imageFS struct {
+	layers []string
+	union  bool
+	// release gives the directory back to the driver
+	release func()
+}
+
+// (g *GraphTool) openImageFS opens the files of img, Close releases them
+func (g *GraphTool) openImageFS(img *image.Image) (*imageFS, error) {
+	switch g.graphDriver.String() {
+	case "aufs":
+		history, err := g.imageHistory(img)
+		if err != nil {
+			return nil, err
+		}
+		fs := &imageFS{union: true, release: func() {}}
+		for _, layer := range history {
+			fs.layers = append(fs.layers, filepath.Join(g.DockerRoot, "aufs", "diff", layer.ID))
+		}
+		return fs, nil
+	case "overlay":
+		metadata, err := g.graphDriver.GetMetadata(img.ID)
+		if err != nil {
+			return nil, err
+		}
+		if root, ok := metadata["RootDir"]; ok {
+			return &imageFS{layers: []string{root}, release: func() {}}, nil
+		}
+		return &imageFS{
+			layers:  []string{metadata["UpperDir"], metadata["LowerDir"]},
+			union:   true,
+			release: func() {},
+		}, nil
+	}
+
+	root, err := g.graphDriver.Get(img.ID, "")
+	if err != nil {
+		return nil, err
+	}
+	return &imageFS{
+		layers: []string{root},
+		release: func() {
+			if err := g.graphDriver.Put(img.ID); err != nil {
+				g.logger.Warnf("put %s: %v", img.ID, err)
+			}
+		},
+	}, nil
+}
+
+// (fs *imageFS) Close releases the image
+func (fs *imageFS) Close() {
+	fs.release()
+}
+
+// (fs *imageFS) lookup returns the path on the host of the image path name
+// and its info, the error satisfies os.IsNotExist when the image has no name
+func (fs *imageFS) lookup(name string) (string, os.FileInfo, error) {
+	name = filepath.Clean("/" + name)
+	for _, layer := range fs.layers {
+		path := filepath.Join(layer, name)
+		info, err := os.Lstat(path)
+		if err == nil {
+			if fs.union && isWhiteoutDevice(info) {
+				return "", nil, os.ErrNotExist
+			}
+			return path, info, nil
+		}
+		if !fs.union {
+			return "", nil, err
+		}
+
+		// Hidden from the lower layers by a whiteout, an opaque directory or
+		// a parent that is not a directory anymore
+		for dir := name; dir != "/"; dir = filepath.Dir(dir) {
+			parent := filepath.Dir(dir)
+			if _, err := os.Lstat(filepath.Join(layer, parent, whiteoutPrefix+filepath.Base(dir))); err == nil {
+				return "", nil, os.ErrNotExist
+			}
+			if _, err := os.Lstat(filepath.Join(layer, parent, whiteoutOpaqueDir)); err == nil {
+				return "", nil, os.ErrNotExist
+			}
+			if value, err := lgetxattr(filepath.Join(layer, parent), overlayOpaqueXattr); err == nil && string(value) == "y" {
+				return "", nil, os.ErrNotExist
+			}
+			if dir != name {
+				if info, err := os.Lstat(filepath.Join(layer, dir)); err == nil && !info.IsDir() {
+					return "", nil, os.ErrNotExist
+				}
+			}
+		}
+	}
+	return "", nil, os.ErrNotExist
+}
+
+// isWhiteoutDevice reports whether info is an overlay whiteout, a 0/0 char device
+func isWhiteoutDevice(info os.FileInfo) bool {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && info.Mode()&os.ModeCharDevice != 0 && stat.Rdev == 0
+}
+
+// (fs *imageFS) resolve returns the image path name with its symlinks
+// resolved inside the image root the way symlink.FollowSymlinkInScope does,
+// one path component at a time over the layers: ".." and absolute links stop
+// at the root. The missing parts are kept as they are
+func (fs *imageFS) resolve(name string) (string, error) {
+	resolved := "/"
+	parts := strings.Split(filepath.Clean("/"+name), "/")
+	for links := 0; len(parts) > 0; {
+		part := parts[0]
+		parts = parts[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, part)
+		path, info, err := fs.lookup(next)
+		if os.IsNotExist(err) || (err == nil && info.Mode()&os.ModeSymlink == 0) {
+			resolved = next
+			continue
+		} else if err != nil {
+			return "", err
+		}
+
+		if links++; links > 255 {
+			return "", fmt.Errorf("too many links in %s", name)
+		}
+		target, err := os.Readlink(path)
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			resolved = "/"
+		}
+		parts = append(strings.Split(target, "/"), parts...)
+	}
+	return resolved, nil
+}
+
+// (fs *imageFS) open opens the image path name, following its symlinks
+func (fs *imageFS) open(name string) (*os.File, error) {
+	resolved, err := fs.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	path, _, err := fs.lookup(resolved)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+// (fs *imageFS) tarTree writes the image path name and everything under it
+// to tw, the paths start with base instead of name
+func (fs *imageFS) tarTree(tw *tar.Writer, name string, base string) error {
+	var passwd, group io.Reader
+	if f, err := fs.open("/etc/passwd"); err == nil {
+		defer f.Close()
+		passwd = f
+	}
+	if f, err := fs.open("/etc/group"); err == nil {
+		defer f.Close()
+		group = f
+	}
+	unames, gnames, err := ownerNames(passwd, group)
+	if err != nil {
+		return err
+	}
+
+	ta := &rootfsTar{
+		tw:     tw,
+		prefix: base,
+		seen:   map[fileID]string{},
+		unames: unames,
+		gnames: gnames,
+	}
+	name = filepath.Clean("/" + name)
+	for _, layer := range fs.layers {
+		top := filepath.Join(layer, name)
+		if _, err := os.Lstat(top); err != nil {
+			continue
+		}
+		ta.root = top
+		err := filepath.Walk(top, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			var skip error
+			if info.IsDir() {
+				skip = filepath.SkipDir
+			}
+			if info.Mode()&os.ModeSocket != 0 {
+				return nil
+			}
+			if !fs.union {
+				return ta.addFile(path, info)
+			}
+
+			if path != top && strings.HasPrefix(info.Name(), whiteoutPrefix) {
+				return skip
+			}
+			// Only the entries that are not hidden by an upper layer, the
+			// directories are merged with the upper ones
+			visiblePath, visible, err := fs.lookup(filepath.Join(name, strings.TrimPrefix(path, top)))
+			if os.IsNotExist(err) {
+				return skip
+			} else if err != nil {
+				return err
+			}
+			if visiblePath != path {
+				if info.IsDir() && visible.IsDir() {
+					return nil
+				}
+				return skip
+			}
+			return ta.addFile(path, info)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
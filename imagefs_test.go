@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestImageFSResolve(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "dg-imagefs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	upper, lower := filepath.Join(tmp, "upper"), filepath.Join(tmp, "lower")
+	mkdir := func(path string) {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write := func(path string) {
+		mkdir(filepath.Dir(path))
+		if err := ioutil.WriteFile(path, []byte(path), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	symlink := func(target, path string) {
+		mkdir(filepath.Dir(path))
+		if err := os.Symlink(target, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(filepath.Join(lower, "usr/lib/os-release"))
+	write(filepath.Join(lower, "old/file"))
+	symlink("../usr/lib/os-release", filepath.Join(lower, "etc/os-release"))
+	// The upper layer points into the lower one and removes old
+	symlink("/usr/lib", filepath.Join(upper, "lib"))
+	symlink("../../../../usr", filepath.Join(upper, "escape"))
+	symlink("loop", filepath.Join(upper, "loop"))
+	write(filepath.Join(upper, ".wh.old"))
+	symlink("old/file", filepath.Join(upper, "gone"))
+
+	fs := &imageFS{layers: []string{upper, lower}, union: true}
+	tests := []struct {
+		name, want string
+	}{
+		{"/etc/os-release", "/usr/lib/os-release"},
+		{"lib/os-release", "/usr/lib/os-release"},
+		{"/escape/lib", "/usr/lib"},
+		{"/../../lib/../etc", "/etc"},
+		{"/lib/missing/file", "/usr/lib/missing/file"},
+		{"/gone", "/old/file"},
+	}
+	for _, test := range tests {
+		got, err := fs.resolve(test.name)
+		if err != nil {
+			t.Errorf("resolve(%s): %v", test.name, err)
+		} else if got != test.want {
+			t.Errorf("resolve(%s) = %s, want %s", test.name, got, test.want)
+		}
+	}
+
+	if _, err := fs.resolve("/loop"); err == nil {
+		t.Errorf("resolve(/loop) succeeded")
+	}
+	if _, err := fs.open("/gone"); !os.IsNotExist(err) {
+		t.Errorf("open(/gone) through a whiteout: %v", err)
+	}
+	if f, err := fs.open("/etc/os-release"); err != nil {
+		t.Errorf("open(/etc/os-release): %v", err)
+	} else {
+		f.Close()
+	}
+}
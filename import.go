@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/chrootarchive"
+	"github.com/docker/docker/pkg/parsers"
+	"github.com/docker/docker/pkg/stringutils"
+	"github.com/docker/docker/pkg/symlink"
+	"github.com/docker/docker/runconfig"
+	ocispecs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// (g *GraphTool) Import registers the rootfs src as a new image tagged repoTag.
+// src is a directory, a tarball, compressed or not, or - for a tarball on
+// stdin. A runtime bundle, like the ones of dg bundle, gives its rootfs and
+// its process to the image config. With parentName the layer only holds what
+// differs from the parent image, the deleted files become whiteouts
+func (g *GraphTool) Import(src, repoTag, parentName string, changes []string) (*image.Image, error) {
+	repo, tag := parsers.ParseRepositoryTag(repoTag)
+	if repo == "" {
+		return nil, fmt.Errorf("invalid repository name %q", repoTag)
+	}
+	unlock, err := g.lockGraph()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	var parent *image.Image
+	if parentName != "" {
+		var err error
+		if parent, err = g.LookupImage(parentName); err != nil {
+			return nil, err
+		}
+		if parent == nil {
+			return nil, fmt.Errorf("image %s not found", parentName)
+		}
+	}
+
+	dir := src
+	if info, err := os.Stat(src); src == "-" || (err == nil && !info.IsDir()) {
+		tmpDir, err := ioutil.TempDir(os.TempDir(), "dg-import")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(tmpDir)
+		if err := untarImport(src, tmpDir); err != nil {
+			return nil, err
+		}
+		dir = tmpDir
+	} else if err != nil {
+		return nil, err
+	}
+
+	rootfs, spec, err := bundleRootfs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &runconfig.Config{}
+	if parent != nil {
+		if config, err = copyConfig(parent.Config); err != nil {
+			return nil, err
+		}
+	}
+	if spec != nil && spec.Process != nil {
+		applyProcess(config, spec.Process)
+	}
+	if err := applyChanges(config, changes); err != nil {
+		return nil, err
+	}
+	img, err := newChildImage(parent, "Imported from "+src, config, "dg import "+src)
+	if err != nil {
+		return nil, err
+	}
+
+	var layer archive.Archive
+	if parent != nil {
+		view, cleanup, err := g.mountView(parent)
+		if err != nil {
+			return nil, err
+		}
+		defer cleanup()
+		diff, err := archive.ChangesDirs(rootfs, view)
+		if err != nil {
+			return nil, err
+		}
+		if layer, err = archive.ExportChanges(rootfs, diff); err != nil {
+			return nil, err
+		}
+	} else if layer, err = archive.Tar(rootfs, archive.Uncompressed); err != nil {
+		return nil, err
+	}
+	defer layer.Close()
+
+	if err := g.registerImage(img, layer, repo, tag); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// untarImport unpacks the tarball src, - for stdin, in dir. The tarball is
+// unpacked chrooted in dir so its paths can't escape it
+func untarImport(src, dir string) error {
+	var in io.ReadCloser = os.Stdin
+	if src != "-" {
+		f, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		in = f
+	}
+	defer in.Close()
+
+	rdr, err := archive.DecompressStream(in)
+	if err != nil {
+		return err
+	}
+	defer rdr.Close()
+	return chrootarchive.UntarUncompressed(rdr, dir, &archive.TarOptions{})
+}
+
+// bundleRootfs returns the rootfs of dir and its spec when dir is a runtime
+// bundle, both spec versions of dg bundle share the fields read here.
+// Otherwise dir is the rootfs itself
+func bundleRootfs(dir string) (string, *ocispecs.Spec, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "config.json"))
+	if os.IsNotExist(err) {
+		return dir, nil, nil
+	} else if err != nil {
+		return "", nil, err
+	}
+
+	spec := &ocispecs.Spec{}
+	if err := json.Unmarshal(data, spec); err != nil {
+		// A rootfs with a config.json of its own
+		return dir, nil, nil
+	}
+	rootfs := "rootfs"
+	if spec.Root != nil && spec.Root.Path != "" {
+		rootfs = spec.Root.Path
+	}
+	// The bundle may come from a tarball, its rootfs stays inside it
+	rootfs, err = symlink.FollowSymlinkInScope(filepath.Join(dir, rootfs), dir)
+	if err != nil {
+		return "", nil, err
+	}
+	if !isDir(rootfs) {
+		return dir, nil, nil
+	}
+	return rootfs, spec, nil
+}
+
+// applyProcess sets the command, environment, working directory and user of
+// config from a bundle process. A command equal to the entrypoint and command
+// of config leaves them as they are
+func applyProcess(config *runconfig.Config, process *ocispecs.Process) {
+	if len(process.Args) > 0 {
+		current := append([]string{}, config.Entrypoint.Slice()...)
+		current = append(current, config.Cmd.Slice()...)
+		if strings.Join(current, "\x00") != strings.Join(process.Args, "\x00") {
+			config.Entrypoint = nil
+			config.Cmd = stringutils.NewStrSlice(process.Args...)
+		}
+	}
+	config.Env = process.Env
+	if process.Cwd == "/" {
+		config.WorkingDir = ""
+	} else if process.Cwd != "" {
+		config.WorkingDir = process.Cwd
+	}
+	if process.User.UID != 0 || process.User.GID != 0 {
+		config.User = fmt.Sprintf("%d:%d", process.User.UID, process.User.GID)
+	} else {
+		config.User = ""
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// layersizeFile is the file of the graph that keeps the size of a layer
+const layersizeFile = "layersize"
+
+// GraphDriverData is the storage driver of a layer and its metadata, e.g.
+// the overlay directories or the devicemapper device
+type GraphDriverData struct {
+	Name string            `json:"name"`
+	Data map[string]string `json:"data"`
+}
+
+// InspectResult is what dg inspect prints for an image or a layer
+type InspectResult struct {
+	ID string `json:"id"`
+	// Image is the json file of the layer as docker wrote it
+	Image map[string]interface{} `json:"image"`
+	// LayerSize is the content of the layersize file, -1 when there is none
+	LayerSize   int64           `json:"layer_size"`
+	VirtualSize int64           `json:"virtual_size"`
+	Digest      string          `json:"digest,omitempty"`
+	Tags        []string        `json:"tags"`
+	GraphDriver GraphDriverData `json:"graph_driver"`
+}
+
+// (g *GraphTool) inspect returns the raw and driver metadata of an image or layer
+func (g *GraphTool) inspect(name string) (*InspectResult, error) {
+	img, err := g.LookupImage(name)
+	if err != nil {
+		return nil, err
+	}
+	if img == nil {
+		return nil, fmt.Errorf("no such image or layer: %s", name)
+	}
+
+	raw, err := g.graphHandler.RawJSON(img.ID)
+	if err != nil {
+		return nil, err
+	}
+	result := &InspectResult{
+		ID:        img.ID,
+		LayerSize: -1,
+		Tags:      g.tagStore.ByID()[img.ID],
+		GraphDriver: GraphDriverData{
+			Name: g.graphDriver.String(),
+		},
+	}
+	if err := json.Unmarshal(raw, &result.Image); err != nil {
+		return nil, fmt.Errorf("invalid json for %s: %v", img.ID, err)
+	}
+	if result.Tags == nil {
+		result.Tags = []string{}
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(g.DockerRoot, "graph", img.ID, layersizeFile))
+	if err == nil {
+		if result.LayerSize, err = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid layersize for %s: %v", img.ID, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	result.VirtualSize = g.graphHandler.GetParentsSize(img) + img.Size
+
+	if d, err := g.graphHandler.GetDigest(img.ID); err == nil {
+		result.Digest = d.String()
+	}
+
+	if result.GraphDriver.Data, err = g.graphDriver.GetMetadata(img.ID); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// (g *GraphTool) Inspect prints the metadata of each name as a json array, or
+// each through the template format. The names that can't be found are
+// reported once the others are printed
+func (g *GraphTool) Inspect(names []string, format string) error {
+	items := []interface{}{}
+	missing := []string{}
+	for _, name := range names {
+		result, err := g.inspect(name)
+		if err != nil {
+			g.logger.Errorf("%s: %v", name, err)
+			missing = append(missing, name)
+			continue
+		}
+		items = append(items, result)
+	}
+
+	var err error
+	if format == "" || format == outputTable {
+		err = printJSON(os.Stdout, items)
+	} else {
+		err = printOutput(format, items, func(w *tabwriter.Writer) {})
+	}
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("failed to inspect %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
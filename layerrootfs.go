@@ -0,0 +1,419 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/docker/docker/image"
+	"github.com/opencontainers/runc/libcontainer/user"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	// whiteoutMetaPrefix marks the aufs internal files, .wh..wh..opq included
+	whiteoutMetaPrefix = whiteoutPrefix + whiteoutPrefix
+	whiteoutOpaqueDir  = whiteoutMetaPrefix + ".opq"
+	overlayOpaqueXattr = "trusted.overlay.opaque"
+)
+
+// layerNode is a path of the stacked layers, layer is the index of the
+// layer that last wrote it
+type layerNode struct {
+	layer    int
+	children map[string]*layerNode
+}
+
+// layerRootfs is the rootfs of an image built from its layer tars, without
+// mounting anything. The layers are read twice: the first pass applies the
+// whiteouts to a tree of paths, the second one writes the entries that survived
+type layerRootfs struct {
+	g     *GraphTool
+	depth int
+	// layerTar returns the tar of layer i, base is 0
+	layerTar func(i int) (io.ReadCloser, error)
+	root     *layerNode
+	// rootDir is the header of the root directory in the top layer that has one
+	rootDir *tar.Header
+	// passwd and group of the image, nil when it has none
+	passwd []byte
+	group  []byte
+}
+
+// (g *GraphTool) newLayerRootfs stacks the layers of img, base first
+func (g *GraphTool) newLayerRootfs(img *image.Image) (*layerRootfs, error) {
+	history, err := g.imageHistory(img)
+	if err != nil {
+		return nil, err
+	}
+	var layers []*image.Image
+	for i := len(history) - 1; i >= 0; i-- {
+		layers = append(layers, history[i])
+	}
+	return g.stackLayers(len(layers), func(i int) (io.ReadCloser, error) {
+		return g.layerTar(layers[i])
+	})
+}
+
+// (g *GraphTool) stackLayers stacks depth layers, layerTar returns the tar
+// of layer i, base is 0
+func (g *GraphTool) stackLayers(depth int, layerTar func(i int) (io.ReadCloser, error)) (*layerRootfs, error) {
+	lr := &layerRootfs{
+		g:        g,
+		depth:    depth,
+		layerTar: layerTar,
+		root:     &layerNode{layer: -1, children: map[string]*layerNode{}},
+	}
+
+	// The layer that wrote the passwd and group files and their content
+	type layerFile struct {
+		layer int
+		data  []byte
+	}
+	files := map[string]layerFile{}
+	for i := 0; i < depth; i++ {
+		err := lr.readLayer(i, func(name string, hdr *tar.Header, tr *tar.Reader) error {
+			if (name == "/etc/passwd" || name == "/etc/group") && hdr.Typeflag == tar.TypeReg {
+				data, err := ioutil.ReadAll(tr)
+				if err != nil {
+					return err
+				}
+				files[name] = layerFile{i, data}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Only the versions that survived the upper layers count
+	if f, ok := files["/etc/passwd"]; ok {
+		if node := lr.lookup("/etc/passwd"); node != nil && node.layer == f.layer {
+			lr.passwd = f.data
+		}
+	}
+	if f, ok := files["/etc/group"]; ok {
+		if node := lr.lookup("/etc/group"); node != nil && node.layer == f.layer {
+			lr.group = f.data
+		}
+	}
+	return lr, nil
+}
+
+// (g *GraphTool) layerTar returns the tar of a single layer. The aufs diff
+// directories are read directly, Diff doesn't mount them while TarLayer would
+func (g *GraphTool) layerTar(img *image.Image) (io.ReadCloser, error) {
+	if g.graphDriver.String() == "aufs" {
+		return g.graphDriver.Diff(img.ID, img.Parent)
+	}
+	return g.graphHandler.TarLayer(img)
+}
+
+// (lr *layerRootfs) readLayer applies the whiteouts of layer i to the tree
+// and records its entries, fn is called with every entry that is not a whiteout
+func (lr *layerRootfs) readLayer(i int, fn func(name string, hdr *tar.Header, tr *tar.Reader) error) error {
+	rdr, err := lr.layerTar(i)
+	if err != nil {
+		return err
+	}
+	defer rdr.Close()
+
+	tr := tar.NewReader(rdr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		name := path.Clean("/" + hdr.Name)
+		if name == "/" {
+			if hdr.Typeflag == tar.TypeDir {
+				lr.rootDir = hdr
+			}
+			continue
+		}
+		dir, base := path.Split(name)
+
+		switch {
+		case base == whiteoutOpaqueDir:
+			lr.clearLower(lr.ensure(dir), i)
+			continue
+		case strings.HasPrefix(base, whiteoutMetaPrefix):
+			// aufs hardlink and xino files
+			continue
+		case strings.HasPrefix(base, whiteoutPrefix):
+			lr.remove(path.Join(dir, base[len(whiteoutPrefix):]), i)
+			continue
+		case isOverlayWhiteout(hdr):
+			lr.remove(name, i)
+			continue
+		}
+
+		node := lr.ensure(name)
+		node.layer = i
+		if hdr.Typeflag != tar.TypeDir {
+			node.children = nil
+		} else if node.children == nil {
+			node.children = map[string]*layerNode{}
+		} else if hdr.Xattrs[overlayOpaqueXattr] == "y" {
+			lr.clearLower(node, i)
+		}
+
+		if err := fn(name, hdr, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// withoutXattr returns a copy of hdr without the xattr name. The fields are
+// copied one by one, the newer archive/tar also keeps the xattrs it read in
+// the PAX records of the header and would write them back
+func withoutXattr(hdr *tar.Header, name string) *tar.Header {
+	var xattrs map[string]string
+	for k, v := range hdr.Xattrs {
+		if k == name {
+			continue
+		}
+		if xattrs == nil {
+			xattrs = map[string]string{}
+		}
+		xattrs[k] = v
+	}
+	return &tar.Header{
+		Name:       hdr.Name,
+		Mode:       hdr.Mode,
+		Uid:        hdr.Uid,
+		Gid:        hdr.Gid,
+		Size:       hdr.Size,
+		ModTime:    hdr.ModTime,
+		Typeflag:   hdr.Typeflag,
+		Linkname:   hdr.Linkname,
+		Uname:      hdr.Uname,
+		Gname:      hdr.Gname,
+		Devmajor:   hdr.Devmajor,
+		Devminor:   hdr.Devminor,
+		AccessTime: hdr.AccessTime,
+		ChangeTime: hdr.ChangeTime,
+		Xattrs:     xattrs,
+	}
+}
+
+// isOverlayWhiteout reports whether hdr is an overlay whiteout, a 0/0 char device
+func isOverlayWhiteout(hdr *tar.Header) bool {
+	return hdr.Typeflag == tar.TypeChar && hdr.Devmajor == 0 && hdr.Devminor == 0
+}
+
+// (lr *layerRootfs) ensure returns the node of name, creating the missing parents
+func (lr *layerRootfs) ensure(name string) *layerNode {
+	node := lr.root
+	for _, part := range strings.Split(strings.Trim(name, "/"), "/") {
+		if part == "" {
+			continue
+		}
+		if node.children == nil {
+			node.children = map[string]*layerNode{}
+		}
+		child, ok := node.children[part]
+		if !ok {
+			child = &layerNode{layer: -1}
+			node.children[part] = child
+		}
+		node = child
+	}
+	return node
+}
+
+// (lr *layerRootfs) lookup returns the node of name or nil
+func (lr *layerRootfs) lookup(name string) *layerNode {
+	node := lr.root
+	for _, part := range strings.Split(strings.Trim(name, "/"), "/") {
+		if part == "" {
+			continue
+		}
+		if node = node.children[part]; node == nil {
+			return nil
+		}
+	}
+	return node
+}
+
+// (lr *layerRootfs) remove drops name and everything under it written below layer i
+func (lr *layerRootfs) remove(name string, i int) {
+	dir, base := path.Split(name)
+	parent := lr.lookup(dir)
+	if parent == nil {
+		return
+	}
+	if child, ok := parent.children[base]; ok && child.layer < i {
+		delete(parent.children, base)
+	}
+}
+
+// (lr *layerRootfs) clearLower drops the children of node written below layer i
+func (lr *layerRootfs) clearLower(node *layerNode, i int) {
+	for name, child := range node.children {
+		if child.layer < i {
+			delete(node.children, name)
+		}
+	}
+}
+
+// (lr *layerRootfs) resolveUser resolves userSpec with the image passwd and group
+func (lr *layerRootfs) resolveUser(userSpec string) (*user.ExecUser, error) {
+	var passwd, group io.Reader
+	if lr.passwd != nil {
+		passwd = bytes.NewReader(lr.passwd)
+	}
+	if lr.group != nil {
+		group = bytes.NewReader(lr.group)
+	}
+	return user.GetExecUser(userSpec, defaultExecUser, passwd, group)
+}
+
+// (lr *layerRootfs) writeTo writes the surviving entries to tw with their
+// paths under prefix. The entries come out layer by layer, base first.
+// It returns the number of bytes of file content written
+func (lr *layerRootfs) writeTo(tw *tar.Writer, prefix string) (int64, error) {
+	var passwd, group io.Reader
+	if lr.passwd != nil {
+		passwd = bytes.NewReader(lr.passwd)
+	}
+	if lr.group != nil {
+		group = bytes.NewReader(lr.group)
+	}
+	unames, gnames, err := ownerNames(passwd, group)
+	if err != nil {
+		return 0, err
+	}
+
+	// The drivers leave the root out of the layer tars they make, it is
+	// then the 0755 directory the driver created
+	root := &tar.Header{Mode: 0755, Typeflag: tar.TypeDir}
+	if lr.rootDir != nil {
+		root = withoutXattr(lr.rootDir, overlayOpaqueXattr)
+	}
+	root.Name = prefix + "/"
+	root.Uname = unames[root.Uid]
+	root.Gname = gnames[root.Gid]
+	if err := tw.WriteHeader(root); err != nil {
+		return 0, err
+	}
+
+	var copied int64
+	for i := 0; i < lr.depth; i++ {
+		rdr, err := lr.layerTar(i)
+		if err != nil {
+			return copied, err
+		}
+		// The first link to a replaced target, by target
+		relinked := map[string]string{}
+
+		tr := tar.NewReader(rdr)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				rdr.Close()
+				return copied, err
+			}
+
+			name := path.Clean("/" + hdr.Name)
+			_, base := path.Split(name)
+			if name == "/" || strings.HasPrefix(base, whiteoutPrefix) || isOverlayWhiteout(hdr) {
+				continue
+			}
+			// Written again or removed by an upper layer
+			if node := lr.lookup(name); node == nil || node.layer != i {
+				continue
+			}
+
+			var content io.Reader = tr
+			var entry io.Closer
+			if hdr.Typeflag == tar.TypeLink {
+				target := path.Clean("/" + hdr.Linkname)
+				if node := lr.lookup(target); node != nil && node.layer == i {
+					hdr.Linkname = prefix + target
+				} else if first, ok := relinked[target]; ok {
+					hdr.Linkname = prefix + first
+				} else {
+					// The target was replaced or removed by an upper layer,
+					// the link becomes a file with the content of this layer
+					thdr, r, err := lr.openEntry(i, target)
+					if err != nil {
+						rdr.Close()
+						return copied, err
+					}
+					if thdr == nil {
+						lr.g.logger.Warnf("skipping %s, its link target %s is not in the layer", name, target)
+						continue
+					}
+					hdr, content, entry = thdr, r, r
+					relinked[target] = name
+				}
+			}
+
+			hdr.Name = prefix + name
+			if hdr.Typeflag == tar.TypeDir {
+				hdr.Name += "/"
+			}
+			if _, ok := hdr.Xattrs[overlayOpaqueXattr]; ok {
+				hdr = withoutXattr(hdr, overlayOpaqueXattr)
+			}
+			hdr.Uname = unames[hdr.Uid]
+			hdr.Gname = gnames[hdr.Gid]
+
+			err = tw.WriteHeader(hdr)
+			if err == nil {
+				var n int64
+				n, err = io.Copy(tw, content)
+				copied += n
+			}
+			if entry != nil {
+				entry.Close()
+			}
+			if err != nil {
+				rdr.Close()
+				return copied, err
+			}
+		}
+		rdr.Close()
+	}
+	return copied, nil
+}
+
+// layerEntry is the content of an entry of a layer tar
+type layerEntry struct {
+	*tar.Reader
+	io.Closer
+}
+
+// (lr *layerRootfs) openEntry reads layer i again up to name and returns its
+// header and content, the header is nil when the layer doesn't have it
+func (lr *layerRootfs) openEntry(i int, name string) (*tar.Header, io.ReadCloser, error) {
+	rdr, err := lr.layerTar(i)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tr := tar.NewReader(rdr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			rdr.Close()
+			return nil, nil, nil
+		} else if err != nil {
+			rdr.Close()
+			return nil, nil, err
+		}
+		if path.Clean("/"+hdr.Name) == name && hdr.Typeflag != tar.TypeLink {
+			return hdr, layerEntry{tr, rdr}, nil
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// testEntry is an entry of a test layer tar
+type testEntry struct {
+	hdr     tar.Header
+	content string
+}
+
+func testFile(name, content string) testEntry {
+	return testEntry{tar.Header{Name: name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(content))}, content}
+}
+
+func testDir(name string) testEntry {
+	return testEntry{hdr: tar.Header{Name: name + "/", Mode: 0755, Typeflag: tar.TypeDir}}
+}
+
+func testLink(name, target string) testEntry {
+	return testEntry{hdr: tar.Header{Name: name, Mode: 0644, Typeflag: tar.TypeLink, Linkname: target}}
+}
+
+// testWhiteout is the 0/0 char device overlay leaves for a removed path
+func testWhiteout(name string) testEntry {
+	return testEntry{hdr: tar.Header{Name: name, Typeflag: tar.TypeChar}}
+}
+
+// testRootfs stacks the layers, base first, and returns the entries of the
+// rootfs tar with their content, by name
+func testRootfs(t *testing.T, layers ...[]testEntry) map[string]testEntry {
+	var tars [][]byte
+	for _, entries := range layers {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, e := range entries {
+			hdr := e.hdr
+			if err := tw.WriteHeader(&hdr); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tw.Write([]byte(e.content)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		tars = append(tars, buf.Bytes())
+	}
+
+	g := &GraphTool{logger: logrus.New()}
+	lr, err := g.stackLayers(len(tars), func(i int) (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(tars[i])), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if _, err := lr.writeTo(tw, "rootfs"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rootfs := map[string]testEntry{}
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := rootfs[hdr.Name]; ok {
+			t.Errorf("%s is written twice", hdr.Name)
+		}
+		rootfs[hdr.Name] = testEntry{*hdr, string(content)}
+	}
+	return rootfs
+}
+
+func TestLayerRootfsWhiteout(t *testing.T) {
+	rootfs := testRootfs(t,
+		[]testEntry{
+			testDir("etc"), testFile("etc/a", "a"), testFile("etc/b", "b"), testFile("etc/c", "c"),
+			testDir("var"), testFile("var/x", "x"),
+		},
+		[]testEntry{
+			testDir("etc"), testFile("etc/.wh.a", ""), testWhiteout("etc/b"),
+			testFile(".wh.var", ""),
+		},
+		[]testEntry{
+			testDir("var"), testFile("var/y", "y"),
+		},
+	)
+
+	for _, name := range []string{"rootfs/etc/a", "rootfs/etc/b", "rootfs/etc/.wh.a", "rootfs/.wh.var", "rootfs/var/x"} {
+		if _, ok := rootfs[name]; ok {
+			t.Errorf("%s is not removed", name)
+		}
+	}
+	for _, name := range []string{"rootfs/etc/", "rootfs/etc/c", "rootfs/var/", "rootfs/var/y"} {
+		if _, ok := rootfs[name]; !ok {
+			t.Errorf("%s is missing", name)
+		}
+	}
+}
+
+func TestLayerRootfsOpaque(t *testing.T) {
+	opaque := testDir("srv")
+	opaque.hdr.Xattrs = map[string]string{overlayOpaqueXattr: "y"}
+	rootfs := testRootfs(t,
+		[]testEntry{
+			testDir("opt"), testFile("opt/old", "old"), testDir("opt/sub"), testFile("opt/sub/f", "f"),
+			testDir("srv"), testFile("srv/old", "old"),
+		},
+		[]testEntry{
+			testDir("opt"), testFile("opt/"+whiteoutOpaqueDir, ""), testFile("opt/new", "new"),
+			opaque, testFile("srv/new", "new"),
+		},
+	)
+
+	for _, name := range []string{"rootfs/opt/old", "rootfs/opt/sub/", "rootfs/opt/sub/f", "rootfs/opt/" + whiteoutOpaqueDir, "rootfs/srv/old"} {
+		if _, ok := rootfs[name]; ok {
+			t.Errorf("%s is not hidden by the opaque directory", name)
+		}
+	}
+	for _, name := range []string{"rootfs/opt/new", "rootfs/srv/new"} {
+		if _, ok := rootfs[name]; !ok {
+			t.Errorf("%s is missing", name)
+		}
+	}
+	if _, ok := rootfs["rootfs/srv/"].hdr.Xattrs[overlayOpaqueXattr]; ok {
+		t.Errorf("srv keeps the overlay opaque xattr")
+	}
+}
+
+func TestLayerRootfsHardlink(t *testing.T) {
+	rootfs := testRootfs(t,
+		[]testEntry{
+			testDir("bin"), testFile("bin/tool", "v1"), testLink("bin/alias", "bin/tool"), testLink("bin/alias2", "bin/tool"),
+			testDir("lib"), testFile("lib/kept", "kept"), testLink("lib/kept-link", "lib/kept"),
+			testFile("lib/gone", "gone"), testLink("lib/gone-link", "lib/gone"),
+		},
+		[]testEntry{
+			testDir("bin"), testFile("bin/tool", "v2"),
+			testDir("lib"), testFile("lib/.wh.gone", ""),
+		},
+	)
+
+	tests := []struct {
+		name, content, link string
+	}{
+		{name: "rootfs/bin/tool", content: "v2"},
+		// The links to the replaced tool keep its content from the lower layer
+		{name: "rootfs/bin/alias", content: "v1"},
+		{name: "rootfs/bin/alias2", link: "rootfs/bin/alias"},
+		{name: "rootfs/lib/kept-link", link: "rootfs/lib/kept"},
+		{name: "rootfs/lib/gone-link", content: "gone"},
+	}
+	for _, test := range tests {
+		e, ok := rootfs[test.name]
+		switch {
+		case !ok:
+			t.Errorf("%s is missing", test.name)
+		case test.link != "" && (e.hdr.Typeflag != tar.TypeLink || e.hdr.Linkname != test.link):
+			t.Errorf("%s links to %q, want %s", test.name, e.hdr.Linkname, test.link)
+		case test.link == "" && (e.hdr.Typeflag != tar.TypeReg || e.content != test.content):
+			t.Errorf("%s is %q, want a file with %q", test.name, e.content, test.content)
+		}
+	}
+	if _, ok := rootfs["rootfs/lib/gone"]; ok {
+		t.Errorf("lib/gone is not removed")
+	}
+}
+
+func TestLayerRootfsRootDir(t *testing.T) {
+	rootfs := testRootfs(t, []testEntry{testFile("a", "a")})
+	if hdr := rootfs["rootfs/"].hdr; hdr.Mode != 0755 || hdr.Uid != 0 {
+		t.Errorf("rootfs/ is %o owned by %d, want 0755 owned by 0", hdr.Mode, hdr.Uid)
+	}
+
+	base, top := testDir("."), testDir(".")
+	top.hdr.Mode, top.hdr.Uid, top.hdr.Gid = 0750, 1000, 1000
+	rootfs = testRootfs(t,
+		[]testEntry{base, testFile("a", "a")},
+		[]testEntry{top, testFile("b", "b")},
+		[]testEntry{testFile("c", "c")},
+	)
+	if hdr := rootfs["rootfs/"].hdr; hdr.Mode != 0750 || hdr.Uid != 1000 || hdr.Gid != 1000 {
+		t.Errorf("rootfs/ is %o owned by %d:%d, want 0750 owned by 1000:1000", hdr.Mode, hdr.Uid, hdr.Gid)
+	}
+}
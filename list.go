@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/pkg/parsers/filters"
+	"github.com/docker/docker/pkg/stringid"
+	"github.com/docker/docker/pkg/units"
+)
+
+// ImageRow is a line of dg ls, an image has one per repository tag
+type ImageRow struct {
+	Repository  string            `json:"repository"`
+	Tag         string            `json:"tag"`
+	ID          string            `json:"id"`
+	ParentID    string            `json:"parent_id,omitempty"`
+	Digest      string            `json:"digest,omitempty"`
+	Created     time.Time         `json:"created"`
+	VirtualSize int64             `json:"virtual_size"`
+	Size        int64             `json:"size"`
+	Labels      map[string]string `json:"labels,omitempty"`
+}
+
+// createdFilter holds the reference images of the before and since filters
+type createdFilter struct {
+	before *image.Image
+	since  *image.Image
+}
+
+// (f createdFilter) match reports whether an image passes the filters, created
+// is in seconds as the tag store lists it. The references are truncated to
+// seconds too and never match themselves
+func (f createdFilter) match(id string, created int64) bool {
+	if f.before != nil && (id == f.before.ID || created >= f.before.Created.Unix()) {
+		return false
+	}
+	if f.since != nil && (id == f.since.ID || created <= f.since.Created.Unix()) {
+		return false
+	}
+	return true
+}
+
+// (g *GraphTool) Images lists the images of the graph like docker images.
+// repository is a glob matched against the repository names, filterFlags are
+// key=value filters: dangling, label, before and since. all includes the
+// intermediate layers
+func (g *GraphTool) Images(repository string, filterFlags []string, all bool) ([]*ImageRow, error) {
+	var (
+		imageFilters = filters.Args{}
+		err          error
+		createdRange createdFilter
+	)
+	for _, f := range filterFlags {
+		if imageFilters, err = filters.ParseFlag(f, imageFilters); err != nil {
+			return nil, err
+		}
+	}
+
+	// before and since are applied here, the tag store only knows dangling and label
+	for _, name := range []string{"before", "since"} {
+		values, ok := imageFilters[name]
+		if !ok {
+			continue
+		}
+		delete(imageFilters, name)
+		if len(values) > 1 {
+			return nil, fmt.Errorf("only one %s filter is allowed", name)
+		}
+		img, err := g.LookupImage(values[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s filter: %v", name, err)
+		}
+		if name == "before" {
+			createdRange.before = img
+		} else {
+			createdRange.since = img
+		}
+	}
+
+	filterArgs, err := filters.ToParam(imageFilters)
+	if err != nil {
+		return nil, err
+	}
+	images, err := g.tagStore.Images(filterArgs, repository, all)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := []*ImageRow{}
+	for _, img := range images {
+		if !createdRange.match(img.ID, img.Created) {
+			continue
+		}
+
+		digest := ""
+		if d, err := g.graphHandler.GetDigest(img.ID); err == nil {
+			digest = d.String()
+		}
+
+		refs := img.RepoTags
+		if len(refs) == 0 {
+			// Only pulled by digest
+			refs = []string{"<none>:<none>"}
+		}
+		for _, ref := range refs {
+			repo, tag := ref, "<none>"
+			if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+				repo, tag = ref[:i], ref[i+1:]
+			}
+			rows = append(rows, &ImageRow{
+				Repository:  repo,
+				Tag:         tag,
+				ID:          img.ID,
+				ParentID:    img.ParentID,
+				Digest:      digest,
+				Created:     time.Unix(img.Created, 0).UTC(),
+				VirtualSize: img.VirtualSize,
+				Size:        img.Size,
+				Labels:      img.Labels,
+			})
+		}
+	}
+	return rows, nil
+}
+
+// (g *GraphTool) ListImages prints the images as a table, json or through a template
+func (g *GraphTool) ListImages(repository string, filterFlags []string, all bool, format string) error {
+	rows, err := g.Images(repository, filterFlags, all)
+	if err != nil {
+		return err
+	}
+
+	items := make([]interface{}, 0, len(rows))
+	for _, row := range rows {
+		items = append(items, row)
+	}
+	return printOutput(format, items, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "REPOSITORY\tTAG\tIMAGE ID\tDIGEST\tCREATED\tVIRTUAL SIZE\tSIZE")
+		for _, row := range rows {
+			digest := row.Digest
+			if digest == "" {
+				digest = "<none>"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s ago\t%s\t%s\n",
+				row.Repository,
+				row.Tag,
+				stringid.TruncateID(row.ID),
+				digest,
+				units.HumanDuration(time.Now().UTC().Sub(row.Created)),
+				units.HumanSize(float64(row.VirtualSize)),
+				units.HumanSize(float64(row.Size)),
+			)
+		}
+	})
+}
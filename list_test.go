@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/docker/image"
+)
+
+func TestCreatedFilter(t *testing.T) {
+	// The graph keeps nanoseconds, the tag store lists seconds
+	ref := &image.Image{ID: "ref", Created: time.Unix(1000, 500)}
+	tests := []struct {
+		filter  createdFilter
+		id      string
+		created int64
+		want    bool
+	}{
+		{createdFilter{}, "a", 1000, true},
+		{createdFilter{before: ref}, "ref", 1000, false},
+		{createdFilter{since: ref}, "ref", 1000, false},
+		{createdFilter{before: ref}, "a", 999, true},
+		{createdFilter{before: ref}, "a", 1000, false},
+		{createdFilter{before: ref}, "a", 1001, false},
+		{createdFilter{since: ref}, "a", 999, false},
+		{createdFilter{since: ref}, "a", 1000, false},
+		{createdFilter{since: ref}, "a", 1001, true},
+		{createdFilter{before: &image.Image{ID: "new", Created: time.Unix(2000, 0)}, since: ref}, "a", 1500, true},
+		{createdFilter{before: &image.Image{ID: "new", Created: time.Unix(2000, 0)}, since: ref}, "a", 2500, false},
+	}
+	for i, test := range tests {
+		if got := test.filter.match(test.id, test.created); got != test.want {
+			t.Errorf("%d: match(%s, %d) = %t, want %t", i, test.id, test.created, got, test.want)
+		}
+	}
+}
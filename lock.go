@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// (g *GraphTool) lockGraph makes sure dg is alone changing the graph and the
+// tag store: dockerd keeps them in memory and would overwrite the changes, an
+// other dg would race on them. The returned func releases the lock
+func (g *GraphTool) lockGraph() (func(), error) {
+	path := filepath.Join(g.DockerRoot, "graphtool", "lock")
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("another dg is changing %s", g.DockerRoot)
+		}
+		return nil, fmt.Errorf("lock %s: %v", path, err)
+	}
+	unlock := func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}
+
+	if pid, running := daemonRunning(g.pidfile); running {
+		unlock()
+		return nil, fmt.Errorf("dockerd is running (pid %d from %s), stop it first", pid, g.pidfile)
+	}
+	return unlock, nil
+}
+
+// daemonRunning returns the pid of pidfile and whether it is a live docker
+// process, a stale pidfile whose pid was reused by another program is ignored
+func daemonRunning(pidfile string) (int, bool) {
+	data, err := ioutil.ReadFile(pidfile)
+	if err != nil {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0, false
+	}
+	if err := syscall.Kill(pid, 0); err != nil && err != syscall.EPERM {
+		return pid, false
+	}
+	if comm, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/comm", pid)); err == nil {
+		return pid, strings.Contains(string(comm), "docker")
+	}
+	return pid, true
+}
@@ -1,29 +1,131 @@
 package main
 
 import (
+	"fmt"
+	"github.com/docker/docker/pkg/reexec"
 	"github.com/docopt/docopt-go"
+	"os"
+	"strconv"
 	"strings"
 )
 
 func main() {
+	// The layers are applied by re-executing dg as docker-applyLayer or
+	// docker-untar, chrooted in the layer
+	if reexec.Init() {
+		return
+	}
+
 	usage := `Docker graphtool.
 
 Usage:
-  dg mount [--options=<mount_options>] [<image>] [<dest>]
-  dg umount [--force] <temp_image>
-  dg bundle <image> <bundle_file>
+  dg mount [options] [--storage-opt=<opt>]... [--rw | --ro] [--options=<mount_options>] [--layer=<layer> | --history-index=<n>] [<image>] [<dest>]
+  dg umount [options] [--storage-opt=<opt>]... [--force] <target>
+  dg mounts [options] [--storage-opt=<opt>]...
+  dg commit [options] [--storage-opt=<opt>]... [--message=<message>] [--author=<author>] [--change=<change>...] <target> <repo_tag>
+  dg history [options] [--storage-opt=<opt>]... [--format=<format>] <image>
+  dg tree [options] [--storage-opt=<opt>]... [--format=<format>]
+  dg diff [options] [--storage-opt=<opt>]... [--format=<format>] [--content] <image> [<image2>]
+  dg du [options] [--storage-opt=<opt>]... [--format=<format>] [--repos | --layers] [--delete=<image>...]
+  dg find [options] [--storage-opt=<opt>]... [--format=<format>] <image> <pattern>...
+  dg cat [options] [--storage-opt=<opt>]... <image> <path>
+  dg cp [options] [--storage-opt=<opt>]... [--tag=<repo_tag>] <src> <dest>
+  dg verify [options] [--storage-opt=<opt>]... [--format=<format>] [<name>...]
+  dg import [options] [--storage-opt=<opt>]... [--parent=<image>] [--change=<change>...] <src> <repo_tag>
+  dg squash [options] [--storage-opt=<opt>]... [--from=<layer>] <image> <repo_tag>
+  dg rebase [options] [--storage-opt=<opt>]... [--force] --old-base=<image> --new-base=<image> --tag=<repo_tag> <image>
+  dg config [options] [--storage-opt=<opt>]... --tag=<repo_tag> [--env=<env>...] [--unset-env=<name>...] [--cmd=<cmd>] [--entrypoint=<entrypoint>] [--label=<label>...] [--workdir=<dir>] [--user=<user>] [--expose=<port>...] [--volume=<path>...] <image>
+  dg tag [options] [--storage-opt=<opt>]... [--force] <image> <repo_tag>
+  dg untag [options] [--storage-opt=<opt>]... <repo_tag>
+  dg rmi [options] [--storage-opt=<opt>]... [--force] [--dry-run] <name>...
+  dg save [options] [--storage-opt=<opt>]... [--output=<file>] [--compress=<compression>] <name>...
+  dg load [options] [--storage-opt=<opt>]... [--input=<file>]
+  dg inspect [options] [--storage-opt=<opt>]... [--format=<format>] <name>...
+  dg ls [options] [--storage-opt=<opt>]... [--all] [--filter=<filter>...] [--format=<format>] [<repository>]
+  dg bundle [options] [--storage-opt=<opt>]... [--args=<args>] [--env=<env>...] [--cwd=<cwd>] [--user=<user>] [--format=<format>] [--compress=<compression>] [--spec-version=<version>] [--rootless] <image> <bundle_file>
 
 Options:
   -h --help                        This help
-  -f --force                       Force unmount
-  -o <options> --options=<options> Mount options
+  --root=<root>                    Docker root directory [env: DG_ROOT]
+  -s <driver> --storage-driver=<driver>
+                                   Storage driver, detected when not set [env: DG_STORAGE_DRIVER]
+  --storage-opt=<opt>              Storage driver option, can be repeated [env: DG_STORAGE_OPTS]
+  -f --force                       Force unmount, discards the changes of --rw mounts,
+                                   dg rebase replays the layers despite conflicts,
+                                   dg tag moves an existing tag, dg rmi removes tagged images
+  --rw                             Keep the mount layer so it can be committed
+  --ro                             Mount the image layers read-only, without creating a layer
+  -o <options> --options=<options> Mount options: ro, rw, nosuid, nodev, noexec,
+                                   bind, rbind, [r]private, [r]slave, [r]shared
+                                   and context=<selinux label>
+  --layer=<layer>                  Mount a layer of the image, by id or id prefix
+  --history-index=<n>              Mount the n-th layer of the image history, 0 is the top
+  --args=<args>                    Bundle process args, a json array or space separated words
+  -e <env> --env=<env>             Bundle process or dg config environment variable (KEY=VALUE),
+                                   a bundle KEY alone takes the value of the host environment
+  --cwd=<cwd>                      Bundle process working directory
+  -u <user> --user=<user>          Bundle process user (user[:group]), resolved in the image,
+                                   or dg config user
+  --format=<format>                Bundle format: tar (default) or dir. Listings: table (default),
+                                   json or a Go template, e.g. '{{.Repository}}:{{.Tag}}',
+                                   dg tree also prints Graphviz with dot, dg inspect
+                                   prints json unless given a template
+  --compress=<compression>         Bundle and dg save compression: gzip, bzip2, xz or none,
+                                   guessed from the file extension when not set
+  --spec-version=<version>         Bundle runtime-spec version, 1.2.0 or the legacy 0.2.0
+                                   config.json and runtime.json [default: 1.2.0]
+  --rootless                       Build the bundle rootfs from the layer tars, without mounting
+  --content                        Add the unified diffs of the small text files to dg diff
+  --repos                          Roll dg du up per repository
+  --layers                         Show the dg du of each layer with its refcount
+  --delete=<image>                 Show what deleting the image would free, can be repeated
+  -a --all                         List the intermediate layers too
+  --filter=<filter>                Filter the images: dangling=true, label=<key>[=<value>],
+                                   before=<image> or since=<image>
+  --parent=<image>                 Import the rootfs as a layer on top of the image
+  --from=<layer>                   Squash only the layers above this layer or image
+  --old-base=<image>               The base image the layers are rebased from, in the image history
+  --new-base=<image>               The base image the layers are replayed on
+  -t <repo_tag> --tag=<repo_tag>   Tag of the rebased, reconfigured or copied to image
+  --unset-env=<name>               Remove an environment variable from the config
+  --cmd=<cmd>                      Config cmd, a json array or a shell command, [] clears it
+  --entrypoint=<entrypoint>        Config entrypoint, like --cmd, it resets the cmd
+  --label=<label>                  Config label (key=value)
+  --workdir=<dir>                  Config working directory
+  --expose=<port>                  Expose a port[/proto] or a port range
+  --volume=<path>                  Add a volume to the config
+  --output=<file>                  dg save archive, - for stdout [default: -]
+  -i <file> --input=<file>         dg load archive, - for stdin [default: -]
+  -n --dry-run                     Print what dg rmi would untag and delete without changing anything
+  -m <message> --message=<message> Commit message
+  --author=<author>                Author of the committed image
+  -c <change> --change=<change>    Apply a Dockerfile instruction to the image config:
+                                   ENV, CMD, ENTRYPOINT, LABEL, WORKDIR or USER
+
+The umount and commit <target> can be either the mount point or the temporary layer id.
+The bundle is written to stdout when <bundle_file> is -.
+One of the dg cp <src> and <dest> is <image>:<path>, <dest> - writes a tar to stdout.
+dg diff compares <image> to its parent layer when <image2> is not given.
 `
 	arguments, err := docopt.Parse(usage, nil, true, "docker dist 0.1", false)
 	if err != nil {
 		panic(err.Error())
 	}
 
-	graphtool := NewGraphTool("/var/lib/docker")
+	storageOpts := optList(arguments, "--storage-opt")
+	if len(storageOpts) == 0 && os.Getenv("DG_STORAGE_OPTS") != "" {
+		storageOpts = strings.Split(os.Getenv("DG_STORAGE_OPTS"), ",")
+	}
+
+	graphtool := NewGraphTool(
+		optEnv(arguments, "--root", "DG_ROOT"),
+		optEnv(arguments, "--storage-driver", "DG_STORAGE_DRIVER"),
+		storageOpts,
+	)
+	graphtool.NoMount = arguments["bundle"].(bool) && arguments["--rootless"].(bool)
+	if err := graphtool.InitDriver(); err != nil {
+		graphtool.logger.Fatal(err.Error())
+	}
 
 	if arguments["mount"].(bool) {
 		image := arguments["<image>"].(string)
@@ -33,12 +135,194 @@ Options:
 			options = strings.Split(arguments["--options"].(string), ",")
 		}
 
-		if err := graphtool.Mount(image, dest, options); err != nil {
+		if arguments["--layer"] != nil || arguments["--history-index"] != nil {
+			index := 0
+			if arguments["--history-index"] != nil {
+				if index, err = strconv.Atoi(arguments["--history-index"].(string)); err != nil {
+					graphtool.logger.Fatalf("invalid history index: %v", err)
+				}
+			}
+			layer, err := graphtool.ResolveLayer(image, optString(arguments, "--layer"), index)
+			if err != nil {
+				graphtool.logger.Fatal(err.Error())
+			}
+			image = layer.ID
+		}
+
+		mode := mountScratch
+		if arguments["--rw"].(bool) {
+			mode = mountWritable
+		} else if arguments["--ro"].(bool) {
+			mode = mountReadOnly
+		}
+
+		if err := graphtool.Mount(image, dest, options, mode); err != nil {
 			graphtool.logger.Fatal(err.Error())
 		}
 	} else if arguments["umount"].(bool) {
-		graphtool.Unmount(arguments["<mount_point>"].(string))
+		if err := graphtool.Unmount(arguments["<target>"].(string), arguments["--force"].(bool)); err != nil {
+			graphtool.logger.Fatal(err.Error())
+		}
+	} else if arguments["mounts"].(bool) {
+		if err := graphtool.ListMounts(); err != nil {
+			graphtool.logger.Fatal(err.Error())
+		}
+	} else if arguments["commit"].(bool) {
+		image, err := graphtool.Commit(
+			arguments["<target>"].(string),
+			arguments["<repo_tag>"].(string),
+			optString(arguments, "--message"),
+			optString(arguments, "--author"),
+			optList(arguments, "--change"),
+		)
+		if err != nil {
+			graphtool.logger.Fatal(err.Error())
+		}
+		fmt.Println(image.ID)
+	} else if arguments["history"].(bool) {
+		if err := graphtool.History(arguments["<image>"].(string), optString(arguments, "--format")); err != nil {
+			graphtool.logger.Fatal(err.Error())
+		}
+	} else if arguments["tree"].(bool) {
+		if err := graphtool.Tree(optString(arguments, "--format")); err != nil {
+			graphtool.logger.Fatal(err.Error())
+		}
+	} else if arguments["diff"].(bool) {
+		if err := graphtool.Diff(arguments["<image>"].(string), optString(arguments, "<image2>"), optString(arguments, "--format"), arguments["--content"].(bool)); err != nil {
+			graphtool.logger.Fatal(err.Error())
+		}
+	} else if arguments["du"].(bool) {
+		if err := graphtool.DiskUsage(arguments["--repos"].(bool), arguments["--layers"].(bool), optList(arguments, "--delete"), optString(arguments, "--format")); err != nil {
+			graphtool.logger.Fatal(err.Error())
+		}
+	} else if arguments["find"].(bool) {
+		if err := graphtool.Find(arguments["<image>"].(string), optList(arguments, "<pattern>"), optString(arguments, "--format")); err != nil {
+			graphtool.logger.Fatal(err.Error())
+		}
+	} else if arguments["cat"].(bool) {
+		if err := graphtool.Cat(arguments["<image>"].(string), arguments["<path>"].(string)); err != nil {
+			graphtool.logger.Fatal(err.Error())
+		}
+	} else if arguments["cp"].(bool) {
+		if err := graphtool.Copy(arguments["<src>"].(string), arguments["<dest>"].(string), optString(arguments, "--tag")); err != nil {
+			graphtool.logger.Fatal(err.Error())
+		}
+	} else if arguments["verify"].(bool) {
+		if err := graphtool.Verify(optList(arguments, "<name>"), optString(arguments, "--format")); err != nil {
+			graphtool.logger.Fatal(err.Error())
+		}
+	} else if arguments["import"].(bool) {
+		img, err := graphtool.Import(arguments["<src>"].(string), arguments["<repo_tag>"].(string), optString(arguments, "--parent"), optList(arguments, "--change"))
+		if err != nil {
+			graphtool.logger.Fatal(err.Error())
+		}
+		fmt.Println(img.ID)
+	} else if arguments["squash"].(bool) {
+		img, err := graphtool.Squash(arguments["<image>"].(string), arguments["<repo_tag>"].(string), optString(arguments, "--from"))
+		if err != nil {
+			graphtool.logger.Fatal(err.Error())
+		}
+		fmt.Println(img.ID)
+	} else if arguments["rebase"].(bool) {
+		img, err := graphtool.Rebase(
+			arguments["<image>"].(string),
+			optString(arguments, "--old-base"),
+			optString(arguments, "--new-base"),
+			optString(arguments, "--tag"),
+			arguments["--force"].(bool),
+		)
+		if err != nil {
+			graphtool.logger.Fatal(err.Error())
+		}
+		fmt.Println(img.ID)
+	} else if arguments["config"].(bool) {
+		options := &ConfigOptions{
+			Env:        optList(arguments, "--env"),
+			UnsetEnv:   optList(arguments, "--unset-env"),
+			Cmd:        optString(arguments, "--cmd"),
+			Entrypoint: optString(arguments, "--entrypoint"),
+			Labels:     optList(arguments, "--label"),
+			WorkDir:    optString(arguments, "--workdir"),
+			User:       optString(arguments, "--user"),
+			Expose:     optList(arguments, "--expose"),
+			Volumes:    optList(arguments, "--volume"),
+		}
+		img, err := graphtool.EditConfig(arguments["<image>"].(string), optString(arguments, "--tag"), options)
+		if err != nil {
+			graphtool.logger.Fatal(err.Error())
+		}
+		fmt.Println(img.ID)
+	} else if arguments["tag"].(bool) {
+		if err := graphtool.TagImage(arguments["<image>"].(string), arguments["<repo_tag>"].(string), arguments["--force"].(bool)); err != nil {
+			graphtool.logger.Fatal(err.Error())
+		}
+	} else if arguments["untag"].(bool) {
+		if err := graphtool.Untag(arguments["<repo_tag>"].(string)); err != nil {
+			graphtool.logger.Fatal(err.Error())
+		}
+	} else if arguments["rmi"].(bool) {
+		if err := graphtool.RemoveImages(optList(arguments, "<name>"), arguments["--force"].(bool), arguments["--dry-run"].(bool)); err != nil {
+			graphtool.logger.Fatal(err.Error())
+		}
+	} else if arguments["save"].(bool) {
+		if err := graphtool.Save(optList(arguments, "<name>"), optString(arguments, "--output"), optString(arguments, "--compress")); err != nil {
+			graphtool.logger.Fatal(err.Error())
+		}
+	} else if arguments["load"].(bool) {
+		if err := graphtool.Load(optString(arguments, "--input")); err != nil {
+			graphtool.logger.Fatal(err.Error())
+		}
+	} else if arguments["inspect"].(bool) {
+		if err := graphtool.Inspect(optList(arguments, "<name>"), optString(arguments, "--format")); err != nil {
+			graphtool.logger.Fatal(err.Error())
+		}
+	} else if arguments["ls"].(bool) {
+		if err := graphtool.ListImages(optString(arguments, "<repository>"), optList(arguments, "--filter"), arguments["--all"].(bool), optString(arguments, "--format")); err != nil {
+			graphtool.logger.Fatal(err.Error())
+		}
 	} else if arguments["bundle"].(bool) {
-		graphtool.Bundle(arguments["<image>"].(string), arguments["<bundle_file>"].(string))
+		options := &BundleOptions{
+			Env:         optList(arguments, "--env"),
+			Cwd:         optString(arguments, "--cwd"),
+			User:        optString(arguments, "--user"),
+			Format:      optString(arguments, "--format"),
+			Compress:    optString(arguments, "--compress"),
+			SpecVersion: optString(arguments, "--spec-version"),
+			Rootless:    arguments["--rootless"].(bool),
+		}
+		if args := optString(arguments, "--args"); args != "" {
+			if options.Args, err = parseArgs(args); err != nil {
+				graphtool.logger.Fatalf("invalid args: %v", err)
+			}
+		}
+
+		if err := graphtool.Bundle(arguments["<image>"].(string), arguments["<bundle_file>"].(string), options); err != nil {
+			graphtool.logger.Fatal(err.Error())
+		}
+	}
+}
+
+// optString returns the value of an optional argument or ""
+func optString(arguments map[string]interface{}, name string) string {
+	if value, ok := arguments[name].(string); ok {
+		return value
+	}
+	return ""
+}
+
+// optEnv returns the value of an optional argument, falling back to
+// the environment variable env
+func optEnv(arguments map[string]interface{}, name string, env string) string {
+	if value := optString(arguments, name); value != "" {
+		return value
+	}
+	return os.Getenv(env)
+}
+
+// optList returns the values of a repeatable argument
+func optList(arguments map[string]interface{}, name string) []string {
+	if values, ok := arguments[name].([]string); ok {
+		return values
 	}
+	return []string{}
 }
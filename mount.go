@@ -1,29 +1,93 @@
 package main
 
 import (
-	"github.com/docker/docker/runconfig"
+	"fmt"
+	"os"
+	"path/filepath"
 	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/docker/pkg/stringid"
+	"github.com/docker/docker/runconfig"
+	"github.com/opencontainers/runc/libcontainer/label"
+)
+
+// mountMode selects what dg mount does with the graph
+type mountMode int
+
+const (
+	// mountScratch creates a temporary layer that is dropped on umount
+	mountScratch mountMode = iota
+	// mountWritable keeps the layer so it can be committed
+	mountWritable
+	// mountReadOnly mounts the existing layers, no layer is created
+	mountReadOnly
 )
 
 // (g *GraphTool) Mount ...
-func (g *GraphTool) Mount(imageName string, dest string, options []string) error {
-	var err error
-	if err = g.InitDriver(); err != nil {
+func (g *GraphTool) Mount(imageName string, dest string, options []string, mode mountMode) error {
+	opts, err := parseMountOptions(options)
+	if err != nil {
 		return err
 	}
+	if mode == mountWritable && opts.flags&syscall.MS_RDONLY != 0 {
+		return fmt.Errorf("a writable mount can't use the ro option")
+	}
 
 	image, err := g.LookupImage(imageName)
 	if image == nil {
+		if err == nil {
+			err = fmt.Errorf("image %s not found", imageName)
+		}
 		return err
 	}
 
+	dest, err = filepath.Abs(dest)
+	if err != nil {
+		return err
+	}
+	// A second mount would hide the first one and leak its layer
+	if record, err := g.mountStore.Lookup(dest); err == nil && record.MountPoint == dest {
+		return fmt.Errorf("%s is already a dg mount, unmount it first", dest)
+	}
+
+	if mode == mountReadOnly {
+		method, helpers, err := g.mountReadOnly(image, dest, opts)
+		if err != nil {
+			return err
+		}
+		return g.mountStore.Add(&MountRecord{
+			MountPoint: dest,
+			Image:      image.ID,
+			Created:    time.Now().UTC(),
+			ReadOnly:   true,
+			Method:     method,
+			Helpers:    helpers,
+		})
+	}
+
+	// The scratch and writable layers are written to the graph
+	unlock, err := g.lockGraph()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	fake_image, err := g.graphHandler.Create(nil, "daedbeef", image.ID, "", "", &runconfig.Config{}, &runconfig.Config{})
 	if err != nil {
 		return err
 	}
 
-	path, _ := g.graphDriver.Get(fake_image.ID, "graphtool")
-	if err = syscall.Mount(path, dest, "none", syscall.MS_BIND, ""); err != nil {
+	path, err := g.graphDriver.Get(fake_image.ID, opts.label)
+	if err != nil {
+		g.graphHandler.Delete(fake_image.ID)
+		return err
+	}
+
+	if err = g.bindMount(path, dest, opts); err != nil {
+		g.graphDriver.Put(fake_image.ID)
+		g.graphHandler.Delete(fake_image.ID)
 		return err
 	}
 
@@ -31,10 +95,119 @@ func (g *GraphTool) Mount(imageName string, dest string, options []string) error
 	// the bind mount is still the last reference to the filesystem
 	g.graphDriver.Put(fake_image.ID)
 
+	return g.mountStore.Add(&MountRecord{
+		MountPoint: dest,
+		Image:      image.ID,
+		Layer:      fake_image.ID,
+		Created:    time.Now().UTC(),
+		Writable:   mode == mountWritable,
+	})
+}
+
+// (g *GraphTool) bindMount binds source on dest and applies opts with
+// a remount, bind mounts ignore most flags on the first mount call
+func (g *GraphTool) bindMount(source, dest string, opts *mountOptions) error {
+	flags := syscall.MS_BIND
+	if opts.recursive {
+		flags |= syscall.MS_REC
+	}
+
+	if err := syscall.Mount(source, dest, "none", uintptr(flags), label.FormatMountLabel("", opts.label)); err != nil {
+		return err
+	}
+
+	if err := g.remount(dest, opts); err != nil {
+		syscall.Unmount(dest, syscall.MNT_DETACH)
+		return err
+	}
 	return nil
 }
 
-// (g *GraphTool) Unmount ...
-func (g *GraphTool) Unmount(target string) error {
-	return syscall.Unmount(target, 0)
+func (g *GraphTool) remount(dest string, opts *mountOptions) error {
+	if opts.flags != 0 {
+		flags := syscall.MS_BIND | syscall.MS_REMOUNT | opts.flags
+		if err := syscall.Mount("", dest, "none", uintptr(flags), ""); err != nil {
+			return fmt.Errorf("remount %s: %v", dest, err)
+		}
+	}
+
+	if opts.propagation != 0 {
+		if err := syscall.Mount("", dest, "none", uintptr(opts.propagation), ""); err != nil {
+			return fmt.Errorf("set propagation of %s: %v", dest, err)
+		}
+	}
+
+	return verifyMount(dest, opts)
+}
+
+// (g *GraphTool) Unmount unmounts a dg mount, target can be the
+// mount point or the temporary layer id, the layer is removed afterwards
+func (g *GraphTool) Unmount(target string, force bool) error {
+	record, err := g.mountStore.Lookup(target)
+	if err != nil {
+		return err
+	}
+
+	if record.Writable && !force {
+		return fmt.Errorf("%s is a writable mount, commit it or use --force to discard the changes", record.MountPoint)
+	}
+
+	// The layer of a scratch or writable mount is deleted from the graph
+	if !record.ReadOnly {
+		unlock, err := g.lockGraph()
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	flags := 0
+	if force {
+		flags = syscall.MNT_DETACH
+	}
+
+	// EINVAL means it is not mounted anymore (e.g. after a reboot),
+	// the layer still has to be cleaned up
+	if err := syscall.Unmount(record.MountPoint, flags); err != nil && err != syscall.EINVAL {
+		return fmt.Errorf("unmount %s: %v", record.MountPoint, err)
+	}
+
+	if record.ReadOnly {
+		g.releaseHelpers(record.Helpers)
+		if record.Method == mountMethodDriver {
+			if err := g.graphDriver.Put(record.Image); err != nil {
+				g.logger.Warnf("put %s: %v", record.Image, err)
+			}
+		}
+		return g.mountStore.Remove(record.MountPoint)
+	}
+
+	// The layer reference was released when it was mounted
+	if err := g.graphHandler.Delete(record.Layer); err != nil && !force {
+		return err
+	}
+
+	return g.mountStore.Remove(record.MountPoint)
+}
+
+// (g *GraphTool) ListMounts prints the active dg mounts
+func (g *GraphTool) ListMounts() error {
+	mounts, err := g.mountStore.List()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 20, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "MOUNT POINT\tIMAGE\tLAYER\tMODE\tCREATED")
+	for _, m := range mounts {
+		mode, layer := "scratch", stringid.TruncateID(m.Layer)
+		if m.Writable {
+			mode = "rw"
+		}
+		if m.ReadOnly {
+			mode, layer = "ro", "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", m.MountPoint, stringid.TruncateID(m.Image), layer, mode, m.Created.Local().Format(time.RFC3339))
+	}
+	return w.Flush()
 }
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/docker/docker/image"
+	"github.com/opencontainers/runc/libcontainer/label"
+)
+
+const (
+	mountMethodBind    = "bind"
+	mountMethodOverlay = "overlay"
+	mountMethodAufs    = "aufs"
+	mountMethodDriver  = "driver"
+)
+
+// (g *GraphTool) mountReadOnly mounts img on dest straight from the existing
+// layers, nothing is written to the graph. It returns how the image was mounted
+// and the intermediate mounts that have to be released on umount
+func (g *GraphTool) mountReadOnly(img *image.Image, dest string, opts *mountOptions) (string, []string, error) {
+	opts.flags |= syscall.MS_RDONLY
+
+	switch g.graphDriver.String() {
+	case "overlay":
+		dir := filepath.Join(g.DockerRoot, "overlay", img.ID)
+		// Image layers of the overlay driver carry a full root
+		if root := filepath.Join(dir, "root"); isDir(root) {
+			return mountMethodBind, nil, g.bindMount(root, dest, opts)
+		}
+		lowerID, err := ioutil.ReadFile(filepath.Join(dir, "lower-id"))
+		if err != nil {
+			return "", nil, err
+		}
+		lowers := []string{
+			filepath.Join(dir, "upper"),
+			filepath.Join(g.DockerRoot, "overlay", string(lowerID), "root"),
+		}
+		helpers, err := g.overlayMount(lowers, dest, opts)
+		return mountMethodOverlay, helpers, err
+	case "aufs":
+		history, err := g.imageHistory(img)
+		if err != nil {
+			return "", nil, err
+		}
+		branches := make([]string, 0, len(history))
+		for _, layer := range history {
+			branches = append(branches, filepath.Join(g.DockerRoot, "aufs", "diff", layer.ID))
+		}
+		return mountMethodAufs, nil, g.aufsMount(branches, dest, opts)
+	}
+
+	// Other drivers can't be stacked by hand, use the image itself
+	path, err := g.graphDriver.Get(img.ID, opts.label)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := g.bindMount(path, dest, opts); err != nil {
+		g.graphDriver.Put(img.ID)
+		return "", nil, err
+	}
+	return mountMethodDriver, nil, nil
+}
+
+// (g *GraphTool) overlayMount mounts a read-only overlay of lowers (top first)
+// on dest. The lowerdir option is clipped to the page size, when the layers don't
+// fit they are grouped in intermediate overlays that are stacked in a second level
+func (g *GraphTool) overlayMount(lowers []string, dest string, opts *mountOptions) ([]string, error) {
+	var helpers []string
+	maxLen := syscall.Getpagesize() - len(label.FormatMountLabel("", opts.label)) - len("lowerdir=") - 1
+
+	if len(strings.Join(lowers, ":")) > maxLen {
+		var (
+			groups [][]string
+			group  []string
+			size   int
+		)
+		for _, lower := range lowers {
+			if len(group) > 0 && size+len(lower)+1 > maxLen {
+				groups = append(groups, group)
+				group, size = nil, 0
+			}
+			group = append(group, lower)
+			size += len(lower) + 1
+		}
+		groups = append(groups, group)
+
+		stacked := []string{}
+		for _, group := range groups {
+			if len(group) == 1 {
+				stacked = append(stacked, group[0])
+				continue
+			}
+			helper, err := g.helperDir()
+			if err != nil {
+				g.releaseHelpers(helpers)
+				return nil, err
+			}
+			data := label.FormatMountLabel("lowerdir="+strings.Join(group, ":"), opts.label)
+			if err := syscall.Mount("overlay", helper, "overlay", syscall.MS_RDONLY, data); err != nil {
+				os.Remove(helper)
+				g.releaseHelpers(helpers)
+				return nil, fmt.Errorf("error creating overlay mount to %s: %v", helper, err)
+			}
+			helpers = append(helpers, helper)
+			stacked = append(stacked, helper)
+		}
+		lowers = stacked
+
+		if len(strings.Join(lowers, ":")) > maxLen {
+			g.releaseHelpers(helpers)
+			return nil, fmt.Errorf("too many layers to build an overlay mount")
+		}
+	}
+
+	var err error
+	if len(lowers) == 1 {
+		err = g.bindMount(lowers[0], dest, opts)
+	} else {
+		data := label.FormatMountLabel("lowerdir="+strings.Join(lowers, ":"), opts.label)
+		if err = syscall.Mount("overlay", dest, "overlay", syscall.MS_RDONLY, data); err != nil {
+			err = fmt.Errorf("error creating overlay mount to %s: %v", dest, err)
+		} else if err = g.remount(dest, opts); err != nil {
+			syscall.Unmount(dest, syscall.MNT_DETACH)
+		}
+	}
+	if err != nil {
+		g.releaseHelpers(helpers)
+		return nil, err
+	}
+	return helpers, nil
+}
+
+// (g *GraphTool) aufsMount mounts the branches (top first) read-only on dest,
+// like the aufs driver the branches that don't fit in the first mount
+// call are appended with remounts
+func (g *GraphTool) aufsMount(branches []string, dest string, opts *mountOptions) error {
+	maxLen := syscall.Getpagesize() - len(label.FormatMountLabel("", opts.label)) - 54
+
+	data := "br"
+	i := 0
+	for ; i < len(branches); i++ {
+		branch := fmt.Sprintf(":%s=ro+wh", branches[i])
+		if i > 0 && len(data)+len(branch) > maxLen {
+			break
+		}
+		data += branch
+	}
+	data = label.FormatMountLabel(data+",dio,xino=/dev/shm/aufs.xino", opts.label)
+	if err := syscall.Mount("none", dest, "aufs", syscall.MS_RDONLY, data); err != nil {
+		return fmt.Errorf("error creating aufs mount to %s: %v", dest, err)
+	}
+
+	for ; i < len(branches); i++ {
+		data := label.FormatMountLabel(fmt.Sprintf("append:%s=ro+wh", branches[i]), opts.label)
+		if err := syscall.Mount("none", dest, "aufs", syscall.MS_REMOUNT|syscall.MS_RDONLY, data); err != nil {
+			syscall.Unmount(dest, syscall.MNT_DETACH)
+			return fmt.Errorf("error appending aufs branch %s: %v", branches[i], err)
+		}
+	}
+
+	if err := g.remount(dest, opts); err != nil {
+		syscall.Unmount(dest, syscall.MNT_DETACH)
+		return err
+	}
+	return nil
+}
+
+// (g *GraphTool) helperDir creates a directory for an intermediate mount
+func (g *GraphTool) helperDir() (string, error) {
+	dir := filepath.Join(g.DockerRoot, "graphtool", "mnt")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return ioutil.TempDir(dir, "")
+}
+
+// (g *GraphTool) releaseHelpers unmounts and removes intermediate mounts
+func (g *GraphTool) releaseHelpers(helpers []string) {
+	for i := len(helpers) - 1; i >= 0; i-- {
+		if err := syscall.Unmount(helpers[i], syscall.MNT_DETACH); err != nil && err != syscall.EINVAL {
+			g.logger.Warnf("unmount %s: %v", helpers[i], err)
+		}
+		os.Remove(helpers[i])
+	}
+}
+
+func isDir(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.IsDir()
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// mountOptions is the parsed form of the dg mount --options flag
+type mountOptions struct {
+	// flags applied with a remount after the bind mount
+	flags int
+	// propagation type of the mount point, 0 leaves it untouched
+	propagation int
+	recursive   bool
+	// label is the SELinux mount label
+	label string
+}
+
+var mountFlags = map[string]int{
+	"ro":     syscall.MS_RDONLY,
+	"nosuid": syscall.MS_NOSUID,
+	"nodev":  syscall.MS_NODEV,
+	"noexec": syscall.MS_NOEXEC,
+}
+
+var propagationFlags = map[string]int{
+	"private":  syscall.MS_PRIVATE,
+	"rprivate": syscall.MS_PRIVATE | syscall.MS_REC,
+	"slave":    syscall.MS_SLAVE,
+	"rslave":   syscall.MS_SLAVE | syscall.MS_REC,
+	"shared":   syscall.MS_SHARED,
+	"rshared":  syscall.MS_SHARED | syscall.MS_REC,
+}
+
+// parseMountOptions validates the comma separated mount options
+func parseMountOptions(options []string) (*mountOptions, error) {
+	opts := &mountOptions{}
+	for _, o := range options {
+		o = strings.TrimSpace(o)
+		if o == "" {
+			continue
+		}
+
+		if flag, ok := mountFlags[o]; ok {
+			opts.flags |= flag
+			continue
+		}
+
+		if flag, ok := propagationFlags[o]; ok {
+			if opts.propagation != 0 {
+				return nil, fmt.Errorf("mount option %q conflicts with a previous propagation option", o)
+			}
+			opts.propagation = flag
+			continue
+		}
+
+		switch {
+		case o == "rw":
+			opts.flags &^= syscall.MS_RDONLY
+		case o == "bind":
+			opts.recursive = false
+		case o == "rbind":
+			opts.recursive = true
+		case strings.HasPrefix(o, "context="):
+			opts.label = strings.Trim(strings.TrimPrefix(o, "context="), `"`)
+			if opts.label == "" {
+				return nil, fmt.Errorf("mount option %q requires a label", o)
+			}
+		default:
+			return nil, fmt.Errorf("unknown mount option %q", o)
+		}
+	}
+	return opts, nil
+}
+
+// mountInfo is a subset of a /proc/self/mountinfo entry
+type mountInfo struct {
+	mountPoint string
+	options    []string
+	optional   []string
+}
+
+// unescapeMountPath decodes the octal escapes (\040 for a space, \011,
+// \012 and \134) the kernel uses for the paths of mountinfo
+func unescapeMountPath(path string) string {
+	if !strings.Contains(path, "\\") {
+		return path
+	}
+	var b []byte
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) && isOctal(path[i+1]) && isOctal(path[i+2]) && isOctal(path[i+3]) {
+			b = append(b, (path[i+1]-'0')<<6|(path[i+2]-'0')<<3|(path[i+3]-'0'))
+			i += 3
+			continue
+		}
+		b = append(b, path[i])
+	}
+	return string(b)
+}
+
+func isOctal(c byte) bool {
+	return c >= '0' && c <= '7'
+}
+
+// parseMountInfo parses a line of mountinfo, nil when it is malformed
+func parseMountInfo(line string) *mountInfo {
+	// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+	fields := strings.Fields(line)
+	if len(fields) < 7 {
+		return nil
+	}
+	info := &mountInfo{
+		mountPoint: unescapeMountPath(fields[4]),
+		options:    strings.Split(fields[5], ","),
+	}
+	for _, field := range fields[6:] {
+		if field == "-" {
+			break
+		}
+		info.optional = append(info.optional, field)
+	}
+	return info
+}
+
+// (info *mountInfo) propagation returns the propagation types of the mount,
+// private when it has no peer group. A slave can be shared at the same time
+func (info *mountInfo) propagation() map[string]bool {
+	types := map[string]bool{}
+	for _, o := range info.optional {
+		switch {
+		case strings.HasPrefix(o, "shared:"):
+			types["shared"] = true
+		case strings.HasPrefix(o, "master:"):
+			types["slave"] = true
+		}
+	}
+	if len(types) == 0 {
+		types["private"] = true
+	}
+	return types
+}
+
+// getMountInfo returns the last (topmost) mountinfo entry for mountPoint
+func getMountInfo(mountPoint string) (*mountInfo, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var found *mountInfo
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if info := parseMountInfo(s.Text()); info != nil && info.mountPoint == mountPoint {
+			found = info
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%s is not a mount point", mountPoint)
+	}
+	return found, nil
+}
+
+// verifyMount checks the flags the kernel reports for mountPoint match opts
+func verifyMount(mountPoint string, opts *mountOptions) error {
+	info, err := getMountInfo(mountPoint)
+	if err != nil {
+		return err
+	}
+
+	has := make(map[string]bool)
+	for _, o := range info.options {
+		has[o] = true
+	}
+	for name, flag := range mountFlags {
+		if opts.flags&flag != 0 && !has[name] {
+			return fmt.Errorf("mount option %s is not in effect on %s", name, mountPoint)
+		}
+	}
+
+	if opts.propagation == 0 {
+		return nil
+	}
+
+	propagation := info.propagation()
+	for name, flag := range propagationFlags {
+		if flag == opts.propagation && !propagation[strings.TrimPrefix(name, "r")] {
+			got := []string{}
+			for t := range propagation {
+				got = append(got, t)
+			}
+			sort.Strings(got)
+			return fmt.Errorf("mount propagation %s is not in effect on %s, got %s", name, mountPoint, strings.Join(got, " and "))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestUnescapeMountPath(t *testing.T) {
+	tests := map[string]string{
+		"/mnt/plain":            "/mnt/plain",
+		`/mnt/with\040space`:    "/mnt/with space",
+		`/mnt/tab\011and\012nl`: "/mnt/tab\tand\nnl",
+		`/mnt/back\134slash`:    `/mnt/back\slash`,
+		`/mnt/not\04`:           `/mnt/not\04`,
+		`/mnt/not\08x`:          `/mnt/not\08x`,
+	}
+	for escaped, want := range tests {
+		if got := unescapeMountPath(escaped); got != want {
+			t.Errorf("unescapeMountPath(%q) = %q, want %q", escaped, got, want)
+		}
+	}
+}
+
+func TestParseMountOptions(t *testing.T) {
+	tests := []struct {
+		options     []string
+		flags       int
+		propagation int
+		recursive   bool
+		label       string
+		err         bool
+	}{
+		{options: nil},
+		{options: []string{"ro", " nosuid ", "", "nodev"}, flags: syscall.MS_RDONLY | syscall.MS_NOSUID | syscall.MS_NODEV},
+		{options: []string{"ro", "noexec", "rw"}, flags: syscall.MS_NOEXEC},
+		{options: []string{"rbind"}, recursive: true},
+		{options: []string{"rbind", "bind"}},
+		{options: []string{"rslave"}, propagation: syscall.MS_SLAVE | syscall.MS_REC},
+		{options: []string{"private"}, propagation: syscall.MS_PRIVATE},
+		{options: []string{`context="system_u:object_r:svirt_sandbox_file_t:s0"`}, label: "system_u:object_r:svirt_sandbox_file_t:s0"},
+		{options: []string{"context=system_u:object_r:usr_t:s0"}, label: "system_u:object_r:usr_t:s0"},
+		{options: []string{"context="}, err: true},
+		{options: []string{`context=""`}, err: true},
+		{options: []string{"shared", "rprivate"}, err: true},
+		{options: []string{"slave", "slave"}, err: true},
+		{options: []string{"noatime"}, err: true},
+		{options: []string{"remount"}, err: true},
+	}
+	for _, test := range tests {
+		opts, err := parseMountOptions(test.options)
+		if test.err {
+			if err == nil {
+				t.Errorf("parseMountOptions(%q) succeeded, want an error", test.options)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseMountOptions(%q): %v", test.options, err)
+			continue
+		}
+		if opts.flags != test.flags || opts.propagation != test.propagation || opts.recursive != test.recursive || opts.label != test.label {
+			t.Errorf("parseMountOptions(%q) = %+v, want flags %#x, propagation %#x, recursive %t, label %q",
+				test.options, *opts, test.flags, test.propagation, test.recursive, test.label)
+		}
+	}
+}
+
+func TestMountInfoPropagation(t *testing.T) {
+	tests := []struct {
+		line       string
+		mountPoint string
+		want       []string
+	}{
+		{"36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue", "/mnt2", []string{"slave"}},
+		{"25 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw", "/", []string{"shared"}},
+		{"88 25 8:1 /var/lib /mnt/with\\040space rw,nosuid shared:42 master:7 - ext4 /dev/sda1 rw", "/mnt/with space", []string{"shared", "slave"}},
+		{"89 25 0:45 / /tmp/dg ro,nodev - overlay overlay ro", "/tmp/dg", []string{"private"}},
+		{"90 25 0:46 / /tmp/ub rw unbindable - tmpfs tmpfs rw", "/tmp/ub", []string{"private"}},
+	}
+	for _, test := range tests {
+		info := parseMountInfo(test.line)
+		if info == nil {
+			t.Errorf("parseMountInfo(%q) failed", test.line)
+			continue
+		}
+		if info.mountPoint != test.mountPoint {
+			t.Errorf("%q: mount point %q, want %q", test.line, info.mountPoint, test.mountPoint)
+		}
+		got := info.propagation()
+		if len(got) != len(test.want) {
+			t.Errorf("%q: propagation %v, want %v", test.line, got, test.want)
+			continue
+		}
+		for _, want := range test.want {
+			if !got[want] {
+				t.Errorf("%q: propagation %v, want %v", test.line, got, test.want)
+			}
+		}
+	}
+	if info := parseMountInfo("36 35 98:0 /mnt1"); info != nil {
+		t.Errorf("a truncated line is parsed as %+v", info)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// MountRecord describes an active dg mount
+type MountRecord struct {
+	MountPoint string    `json:"mount_point"`
+	Image      string    `json:"image"`
+	Layer      string    `json:"layer"`
+	Created    time.Time `json:"created"`
+	// Writable mounts keep their layer until it is committed
+	Writable bool `json:"writable,omitempty"`
+	// ReadOnly mounts have no layer, Method tells how the image was
+	// mounted and Helpers are the intermediate mounts to release
+	ReadOnly bool     `json:"read_only,omitempty"`
+	Method   string   `json:"method,omitempty"`
+	Helpers  []string `json:"helpers,omitempty"`
+}
+
+// MountStore keeps track of the mounts created by dg so they
+// can be cleaned up later, it is persisted as json under the docker root
+type MountStore struct {
+	path   string
+	Mounts []*MountRecord
+}
+
+// NewMountStore loads the mount store at path, creating it if needed
+func NewMountStore(path string) (*MountStore, error) {
+	abspath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &MountStore{
+		path:   abspath,
+		Mounts: []*MountRecord{},
+	}
+
+	if err := os.MkdirAll(filepath.Dir(abspath), 0700); err != nil {
+		return nil, err
+	}
+	unlock, err := store.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if err := store.reload(); os.IsNotExist(err) {
+		if err := store.save(); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// lock serializes the read-modify-write of the store between dg processes,
+// the returned func releases it
+func (s *MountStore) lock() (func(), error) {
+	f, err := os.OpenFile(s.path+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("lock %s: %v", s.path, err)
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// save replaces the store file at once, the readers never see it half written
+func (s *MountStore) save() error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *MountStore) reload() error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewDecoder(f).Decode(s)
+}
+
+// Add registers a new mount, a mount point has a single record
+func (s *MountStore) Add(record *MountRecord) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := s.reload(); err != nil {
+		return err
+	}
+	for _, m := range s.Mounts {
+		if m.MountPoint == record.MountPoint {
+			return fmt.Errorf("%s is already a dg mount", record.MountPoint)
+		}
+	}
+	s.Mounts = append(s.Mounts, record)
+	return s.save()
+}
+
+// Remove drops the record of the mount at mountPoint
+func (s *MountStore) Remove(mountPoint string) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := s.reload(); err != nil {
+		return err
+	}
+	mounts := []*MountRecord{}
+	for _, m := range s.Mounts {
+		if m.MountPoint != mountPoint {
+			mounts = append(mounts, m)
+		}
+	}
+	s.Mounts = mounts
+	return s.save()
+}
+
+// Lookup finds a mount by its mount point or by its (possibly truncated) layer id
+func (s *MountStore) Lookup(target string) (*MountRecord, error) {
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+
+	if abspath, err := filepath.Abs(target); err == nil {
+		for _, m := range s.Mounts {
+			if m.MountPoint == abspath {
+				return m, nil
+			}
+		}
+	}
+
+	if target == "" {
+		return nil, fmt.Errorf("no dg mount found for %q", target)
+	}
+
+	var found *MountRecord
+	for _, m := range s.Mounts {
+		if m.Layer != "" && strings.HasPrefix(m.Layer, target) {
+			if found != nil {
+				return nil, fmt.Errorf("ambiguous mount %s", target)
+			}
+			found = m
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no dg mount found for %s", target)
+	}
+	return found, nil
+}
+
+// List returns all the registered mounts
+func (s *MountStore) List() ([]*MountRecord, error) {
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s.Mounts, nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	ocispecs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/specs"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// ociSpec maps the legacy config.json and runtime.json to a runtime-spec 1.x config.json
+func ociSpec(spec specs.LinuxSpec, rspec specs.LinuxRuntimeSpec) *ocispecs.Spec {
+	process := &ocispecs.Process{
+		Terminal: spec.Process.Terminal,
+		User: ocispecs.User{
+			UID:            spec.Process.User.UID,
+			GID:            spec.Process.User.GID,
+			AdditionalGids: spec.Process.User.AdditionalGids,
+		},
+		Args: spec.Process.Args,
+		Env:  spec.Process.Env,
+		Cwd:  spec.Process.Cwd,
+		// The legacy capabilities are the ones the process keeps
+		Capabilities: &ocispecs.LinuxCapabilities{
+			Bounding:  spec.Linux.Capabilities,
+			Effective: spec.Linux.Capabilities,
+			Permitted: spec.Linux.Capabilities,
+		},
+	}
+	for _, rlimit := range rspec.Linux.Rlimits {
+		process.Rlimits = append(process.Rlimits, ocispecs.POSIXRlimit{
+			Type: rlimit.Type,
+			Hard: rlimit.Hard,
+			Soft: rlimit.Soft,
+		})
+	}
+
+	oci := &ocispecs.Spec{
+		Version: ocispecs.Version,
+		Process: process,
+		Root: &ocispecs.Root{
+			Path:     spec.Root.Path,
+			Readonly: spec.Root.Readonly,
+		},
+		Hostname: spec.Hostname,
+		Linux:    &ocispecs.Linux{},
+	}
+
+	// The mount points name the mounts of runtime.json
+	for _, mountPoint := range spec.Mounts {
+		mount, ok := rspec.Mounts[mountPoint.Name]
+		if !ok {
+			continue
+		}
+		oci.Mounts = append(oci.Mounts, ocispecs.Mount{
+			Destination: mountPoint.Path,
+			Type:        mount.Type,
+			Source:      mount.Source,
+			Options:     mount.Options,
+		})
+	}
+
+	for _, ns := range rspec.Linux.Namespaces {
+		oci.Linux.Namespaces = append(oci.Linux.Namespaces, ocispecs.LinuxNamespace{
+			Type: ocispecs.LinuxNamespaceType(ns.Type),
+			Path: ns.Path,
+		})
+	}
+
+	// The device cgroup allowed every device listed before 1.0,
+	// it has to be spelled out now
+	resources := &ocispecs.LinuxResources{
+		Devices: []ocispecs.LinuxDeviceCgroup{
+			{
+				Allow:  false,
+				Access: "rwm",
+			},
+		},
+	}
+	for _, device := range rspec.Linux.Devices {
+		fileMode, uid, gid := device.FileMode, device.UID, device.GID
+		major, minor := device.Major, device.Minor
+		oci.Linux.Devices = append(oci.Linux.Devices, ocispecs.LinuxDevice{
+			Path:     device.Path,
+			Type:     string(device.Type),
+			Major:    major,
+			Minor:    minor,
+			FileMode: &fileMode,
+			UID:      &uid,
+			GID:      &gid,
+		})
+		resources.Devices = append(resources.Devices, ocispecs.LinuxDeviceCgroup{
+			Allow:  true,
+			Type:   string(device.Type),
+			Major:  &major,
+			Minor:  &minor,
+			Access: device.Permissions,
+		})
+	}
+	if r := rspec.Linux.Resources; r != nil && r.Memory.Swappiness >= 0 {
+		swappiness := uint64(r.Memory.Swappiness)
+		resources.Memory = &ocispecs.LinuxMemory{Swappiness: &swappiness}
+	}
+	oci.Linux.Resources = resources
+
+	// An allow all filter is the same as no filter, and runtimes built
+	// without seccomp refuse it
+	seccomp := rspec.Linux.Seccomp
+	if seccomp.DefaultAction != "" && (seccomp.DefaultAction != specs.ActAllow || len(seccomp.Syscalls) > 0) {
+		oci.Linux.Seccomp = &ocispecs.LinuxSeccomp{
+			DefaultAction: ocispecs.LinuxSeccompAction(seccomp.DefaultAction),
+		}
+		for _, arch := range seccomp.Architectures {
+			oci.Linux.Seccomp.Architectures = append(oci.Linux.Seccomp.Architectures, ocispecs.Arch(arch))
+		}
+		for _, call := range seccomp.Syscalls {
+			rule := ocispecs.LinuxSyscall{
+				Names:  []string{call.Name},
+				Action: ocispecs.LinuxSeccompAction(call.Action),
+			}
+			for _, arg := range call.Args {
+				rule.Args = append(rule.Args, ocispecs.LinuxSeccompArg{
+					Index:    arg.Index,
+					Value:    arg.Value,
+					ValueTwo: arg.ValueTwo,
+					Op:       ocispecs.LinuxSeccompOperator(arg.Op),
+				})
+			}
+			oci.Linux.Seccomp.Syscalls = append(oci.Linux.Seccomp.Syscalls, rule)
+		}
+	}
+
+	return oci
+}
+
+// ociSchemaURL is where the embedded schemas are registered, config-schema.json
+// references the others relative to it
+const ociSchemaURL = "file:///runtime-spec/schema/"
+
+// validateOCISpec checks a config.json against the runtime-spec JSON schema
+func validateOCISpec(data []byte) error {
+	loader := gojsonschema.NewSchemaLoader()
+	for name, schema := range ociSchemas {
+		if err := loader.AddSchema(ociSchemaURL+name, gojsonschema.NewStringLoader(schema)); err != nil {
+			return fmt.Errorf("runtime-spec schema %s: %v", name, err)
+		}
+	}
+	schema, err := loader.Compile(gojsonschema.NewReferenceLoader(ociSchemaURL + "config-schema.json"))
+	if err != nil {
+		return fmt.Errorf("runtime-spec schema: %v", err)
+	}
+
+	result, err := schema.Validate(gojsonschema.NewBytesLoader(data))
+	if err != nil {
+		return err
+	}
+	if !result.Valid() {
+		errs := []string{}
+		for _, e := range result.Errors() {
+			errs = append(errs, e.String())
+		}
+		sort.Strings(errs)
+		return fmt.Errorf("invalid config.json: %s", strings.Join(errs, ", "))
+	}
+	return nil
+}
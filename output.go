@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+)
+
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+// templateFuncs are available in the --format templates
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"join":  strings.Join,
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+}
+
+// printOutput prints items as an indented json document, or each item through
+// the Go template format, or calls table for the default output
+func printOutput(format string, items []interface{}, table func(w *tabwriter.Writer)) error {
+	switch format {
+	case "", outputTable:
+		// Escaped text, like the tabs of a diff, is written as it is
+		w := tabwriter.NewWriter(os.Stdout, 20, 1, 3, ' ', tabwriter.StripEscape)
+		table(w)
+		return w.Flush()
+	case outputJSON:
+		return printJSON(os.Stdout, items)
+	}
+
+	tmpl, err := template.New("format").Funcs(templateFuncs).Parse(format)
+	if err != nil {
+		return fmt.Errorf("invalid format template: %v", err)
+	}
+	for _, item := range items {
+		if err := tmpl.Execute(os.Stdout, item); err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stdout)
+	}
+	return nil
+}
+
+// printJSON writes v to w as indented json
+func printJSON(w io.Writer, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(data))
+	return err
+}
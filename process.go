@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/pkg/symlink"
+	"github.com/opencontainers/runc/libcontainer/user"
+	"github.com/opencontainers/specs"
+)
+
+// BundleOptions customizes the bundle generated from an image
+type BundleOptions struct {
+	// Args replaces the image entrypoint and cmd
+	Args []string
+	// Env is merged over the image environment
+	Env []string
+	// Cwd replaces the image working dir
+	Cwd string
+	// User replaces the image user, it is resolved inside the rootfs
+	User string
+	// Format is either a tar archive (default) or a directory
+	Format string
+	// Compress compresses the tar archive: gzip, bzip2, xz or none,
+	// when empty it is guessed from the bundle file extension
+	Compress string
+	// SpecVersion selects the runtime-spec of the bundle config, the
+	// current 1.x config.json (default) or the legacy 0.2.0 split files
+	SpecVersion string
+	// Rootless builds the rootfs from the layer tars instead of a mount
+	Rootless bool
+}
+
+const (
+	bundleFormatTar = "tar"
+	bundleFormatDir = "dir"
+)
+
+var defaultEnv = []string{
+	"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+	"TERM=xterm",
+}
+
+// parseArgs parses the --args flag, either a json array or space separated words
+func parseArgs(args string) ([]string, error) {
+	if strings.HasPrefix(strings.TrimSpace(args), "[") {
+		var parsed []string
+		if err := json.Unmarshal([]byte(args), &parsed); err != nil {
+			return nil, err
+		}
+		return parsed, nil
+	}
+	return splitWords(args)
+}
+
+// userResolver resolves a user spec (user, uid, user:group...) to numeric ids
+type userResolver func(userSpec string) (*user.ExecUser, error)
+
+// (g *GraphTool) bundleProcess builds the bundle process from the image
+// config, resolve turns the user to numeric ids
+func (g *GraphTool) bundleProcess(img *image.Image, resolve userResolver, options *BundleOptions) (specs.Process, error) {
+	process := specs.Process{
+		Args: []string{"sh"},
+		Env:  append([]string{}, defaultEnv...),
+		Cwd:  "/",
+	}
+
+	userSpec := ""
+	if config := img.Config; config != nil {
+		args := []string{}
+		if config.Entrypoint != nil {
+			args = append(args, config.Entrypoint.Slice()...)
+		}
+		if config.Cmd != nil {
+			args = append(args, config.Cmd.Slice()...)
+		}
+		if len(args) > 0 {
+			process.Args = args
+		}
+		for _, e := range config.Env {
+			kv := strings.SplitN(e, "=", 2)
+			if len(kv) == 2 {
+				process.Env = setEnv(process.Env, kv[0], kv[1])
+			}
+		}
+		if config.WorkingDir != "" {
+			process.Cwd = config.WorkingDir
+		}
+		userSpec = config.User
+		process.Terminal = config.Tty
+	}
+
+	if options != nil {
+		if len(options.Args) > 0 {
+			process.Args = options.Args
+		}
+		for _, e := range options.Env {
+			kv := strings.SplitN(e, "=", 2)
+			if len(kv) == 1 {
+				// Like docker run -e KEY, the value comes from the host
+				// environment and an unset variable is left out
+				value, ok := os.LookupEnv(kv[0])
+				if !ok {
+					continue
+				}
+				kv = append(kv, value)
+			}
+			process.Env = setEnv(process.Env, kv[0], kv[1])
+		}
+		if options.Cwd != "" {
+			process.Cwd = options.Cwd
+		}
+		if options.User != "" {
+			userSpec = options.User
+		}
+	}
+
+	execUser, err := resolve(userSpec)
+	if err != nil {
+		return process, err
+	}
+	process.User = specs.User{
+		UID: uint32(execUser.Uid),
+		GID: uint32(execUser.Gid),
+	}
+	for _, gid := range execUser.Sgids {
+		process.User.AdditionalGids = append(process.User.AdditionalGids, uint32(gid))
+	}
+
+	hasHome := false
+	for _, e := range process.Env {
+		if strings.HasPrefix(e, "HOME=") {
+			hasHome = true
+		}
+	}
+	if !hasHome {
+		process.Env = append(process.Env, "HOME="+execUser.Home)
+	}
+
+	return process, nil
+}
+
+// resolveUser resolves userSpec (user, uid, user:group...) with the
+// /etc/passwd and /etc/group files found inside rootfs
+func resolveUser(rootfs string, userSpec string) (*user.ExecUser, error) {
+	passwdPath, err := symlink.FollowSymlinkInScope(filepath.Join(rootfs, "/etc/passwd"), rootfs)
+	if err != nil {
+		return nil, err
+	}
+	groupPath, err := symlink.FollowSymlinkInScope(filepath.Join(rootfs, "/etc/group"), rootfs)
+	if err != nil {
+		return nil, err
+	}
+
+	return user.GetExecUserPath(userSpec, defaultExecUser, passwdPath, groupPath)
+}
+
+// defaultExecUser is used when the image has no passwd or group entry
+var defaultExecUser = &user.ExecUser{
+	Uid:  0,
+	Gid:  0,
+	Home: "/",
+}
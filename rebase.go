@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/parsers"
+	"github.com/docker/docker/pkg/stringid"
+)
+
+// RebaseConflict is a path changed by a replayed layer that also changed
+// between the old and the new base
+type RebaseConflict struct {
+	Path  string
+	Layer string
+	// Base is the change of the new base, Change the one of the layer
+	Base   archive.ChangeType
+	Change archive.ChangeType
+}
+
+// (g *GraphTool) Rebase replays the layers of imageName above oldBase on top
+// of newBase and tags the new top as repoTag. Every layer keeps its config,
+// only the lineage changes. The paths a layer changes that also changed from
+// oldBase to newBase are conflicts, they are reported and the rebase stops
+// unless force is set
+func (g *GraphTool) Rebase(imageName, oldBase, newBase, repoTag string, force bool) (*image.Image, error) {
+	repo, tag := parsers.ParseRepositoryTag(repoTag)
+	if repo == "" {
+		return nil, fmt.Errorf("invalid repository name %q", repoTag)
+	}
+	unlock, err := g.lockGraph()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	img, err := g.LookupImage(imageName)
+	if err != nil {
+		return nil, err
+	}
+	if img == nil {
+		return nil, fmt.Errorf("image %s not found", imageName)
+	}
+	history, err := g.imageHistory(img)
+	if err != nil {
+		return nil, err
+	}
+	oldImg, err := g.historyLayer(imageName, history, oldBase)
+	if err != nil {
+		return nil, err
+	}
+	newImg, err := g.LookupImage(newBase)
+	if err != nil {
+		return nil, err
+	}
+	if newImg == nil {
+		return nil, fmt.Errorf("image %s not found", newBase)
+	}
+	if newImg.ID == oldImg.ID {
+		return nil, fmt.Errorf("%s and %s are the same image", oldBase, newBase)
+	}
+
+	// The layers to replay, base first
+	replay := []*image.Image{}
+	for _, layer := range history {
+		if layer.ID == oldImg.ID {
+			break
+		}
+		replay = append([]*image.Image{layer}, replay...)
+	}
+	if len(replay) == 0 {
+		return nil, fmt.Errorf("%s has no layers above %s", imageName, oldBase)
+	}
+
+	conflicts, err := g.rebaseConflicts(oldImg, newImg, replay)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range conflicts {
+		g.logger.Warnf("conflict: %s %s by layer %s, %s by the new base",
+			c.Path,
+			changeName(c.Change),
+			stringid.TruncateID(c.Layer),
+			changeName(c.Base),
+		)
+	}
+	if len(conflicts) > 0 && !force {
+		return nil, fmt.Errorf("%d conflicts between %s and %s, use --force to rebase anyway", len(conflicts), imageName, newBase)
+	}
+
+	parent := newImg.ID
+	var top *image.Image
+	for _, layer := range replay {
+		diff, err := g.graphDriver.Diff(layer.ID, layer.Parent)
+		if err != nil {
+			return nil, err
+		}
+		rebased := *layer
+		rebased.ID = stringid.GenerateRandomID()
+		rebased.Parent = parent
+		rebased.Size = 0
+		err = g.graphHandler.Register(&rebased, diff)
+		diff.Close()
+		if err != nil {
+			return nil, err
+		}
+		g.logger.Debugf("replayed %s as %s", layer.ID, rebased.ID)
+		parent, top = rebased.ID, &rebased
+	}
+
+	if err := g.tagStore.Tag(repo, tag, top.ID, true); err != nil {
+		return nil, err
+	}
+	return top, nil
+}
+
+// (g *GraphTool) rebaseConflicts returns the paths changed by the replay
+// layers that also changed between oldImg and newImg. The directories that
+// only have new content or attributes on the base side are not conflicts
+func (g *GraphTool) rebaseConflicts(oldImg, newImg *image.Image, replay []*image.Image) ([]*RebaseConflict, error) {
+	oldView, cleanupOld, err := g.mountView(oldImg)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanupOld()
+	newView, cleanupNew, err := g.mountView(newImg)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanupNew()
+
+	baseChanges, err := archive.ChangesDirs(newView, oldView)
+	if err != nil {
+		return nil, err
+	}
+	base := map[string]archive.ChangeType{}
+	for _, change := range baseChanges {
+		if change.Kind == archive.ChangeModify && isDir(filepath.Join(newView, change.Path)) {
+			continue
+		}
+		base[change.Path] = change.Kind
+	}
+
+	conflicts := []*RebaseConflict{}
+	for _, layer := range replay {
+		changes, err := g.graphDriver.Changes(layer.ID, layer.Parent)
+		if err != nil {
+			return nil, err
+		}
+		for _, change := range changes {
+			kind, ok := base[change.Path]
+			if !ok {
+				// Under a path the base replaced or deleted
+				for dir := filepath.Dir(change.Path); dir != "/" && !ok; dir = filepath.Dir(dir) {
+					kind, ok = base[dir]
+				}
+			}
+			if ok {
+				conflicts = append(conflicts, &RebaseConflict{
+					Path:   change.Path,
+					Layer:  layer.ID,
+					Base:   kind,
+					Change: change.Kind,
+				})
+			}
+		}
+	}
+	return conflicts, nil
+}
+
+// changeName is the verb of a change kind
+func changeName(kind archive.ChangeType) string {
+	switch kind {
+	case archive.ChangeAdd:
+		return "added"
+	case archive.ChangeDelete:
+		return "deleted"
+	}
+	return "modified"
+}
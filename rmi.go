@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/pkg/parsers"
+	"github.com/docker/docker/pkg/stringid"
+	"github.com/docker/docker/registry"
+)
+
+// (g *GraphTool) TagImage tags imageName as repoTag, force moves a tag that
+// is already on another image
+func (g *GraphTool) TagImage(imageName, repoTag string, force bool) error {
+	repo, tag := parsers.ParseRepositoryTag(repoTag)
+	if repo == "" {
+		return fmt.Errorf("invalid repository name %q", repoTag)
+	}
+	unlock, err := g.lockGraph()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	img, err := g.LookupImage(imageName)
+	if err != nil {
+		return err
+	}
+	if img == nil {
+		return fmt.Errorf("image %s not found", imageName)
+	}
+	return g.tagStore.Tag(repo, tag, img.ID, force)
+}
+
+// (g *GraphTool) Untag removes the tag repoTag, the image stays
+func (g *GraphTool) Untag(repoTag string) error {
+	repo, tag := parsers.ParseRepositoryTag(repoTag)
+	if repo == "" {
+		return fmt.Errorf("invalid repository name %q", repoTag)
+	}
+	if tag == "" {
+		tag = "latest"
+	}
+	unlock, err := g.lockGraph()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	deleted, err := g.tagStore.Delete(repo, tag)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return fmt.Errorf("no such tag %s:%s", repo, tag)
+	}
+	fmt.Printf("Untagged: %s:%s\n", repo, tag)
+	return nil
+}
+
+// rmiState is the graph as the removals leave it, so a dry run sees the
+// effect of the previous names too
+type rmiState struct {
+	tags     map[string][]string
+	children map[string]int
+	// inUse tells why a layer can't go: the containers and dg mounts on it
+	inUse   map[string]string
+	deleted map[string]bool
+	// report is called with "Untagged" and every tag removed, "Deleted" and
+	// every layer deleted
+	report func(action, name string)
+}
+
+// (g *GraphTool) newRmiState returns the state of the graph before any removal
+func (g *GraphTool) newRmiState(report func(action, name string)) (*rmiState, error) {
+	state := &rmiState{
+		tags:     g.tagStore.ByID(),
+		children: map[string]int{},
+		deleted:  map[string]bool{},
+		report:   report,
+	}
+	for id, children := range g.graphHandler.ByParent() {
+		state.children[id] = len(children)
+	}
+	inUse, err := g.imagesInUse()
+	if err != nil {
+		return nil, err
+	}
+	state.inUse = inUse
+	return state, nil
+}
+
+// (g *GraphTool) RemoveImages removes the images names like docker rmi. A tag
+// name drops that tag, an id drops all the tags of the image but only when
+// forced. The image left without tags is deleted with the parents nothing
+// else uses, unless it has children: then an id needs force and only the tags
+// go. The images used by a container or a dg mount are never removed. With
+// dryRun nothing is changed
+func (g *GraphTool) RemoveImages(names []string, force, dryRun bool) error {
+	unlock, err := g.lockGraph()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	prefix := ""
+	if dryRun {
+		prefix = "(dry run) "
+	}
+	state, err := g.newRmiState(func(action, name string) {
+		fmt.Printf("%s%s: %s\n", prefix, action, name)
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := g.removeImage(name, force, dryRun, state); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tagRef splits name into the repository and tag the tag store keeps it as,
+// the tag defaults to latest
+func tagRef(name string) (string, string) {
+	repo, tag := parsers.ParseRepositoryTag(name)
+	if tag == "" {
+		tag = "latest"
+	}
+	return registry.NormalizeLocalName(repo), tag
+}
+
+// (g *GraphTool) isTagRef reports whether name is a repo[:tag] of the tag store
+func (g *GraphTool) isTagRef(name string) bool {
+	repo, tag := tagRef(name)
+	_, ok := g.tagStore.Repositories[repo][tag]
+	return ok
+}
+
+// (g *GraphTool) removeImage removes a single image, every check is done
+// before anything is changed
+func (g *GraphTool) removeImage(name string, force, dryRun bool, state *rmiState) error {
+	img, err := g.LookupImage(name)
+	if err != nil {
+		return err
+	}
+	if img == nil || state.deleted[img.ID] {
+		return fmt.Errorf("image %s not found", name)
+	}
+
+	refs := state.tags[img.ID]
+	untag, kept := []string{}, []string{}
+	// A name that is both a tag and an id prefix is the tag
+	byID := !g.isTagRef(name)
+	if byID {
+		if len(refs) > 0 && !force {
+			return fmt.Errorf("image %s is tagged as %s, use --force to remove it", name, strings.Join(refs, ", "))
+		}
+		untag = refs
+	} else {
+		repo, tag := tagRef(name)
+		for _, ref := range refs {
+			if ref == repo+":"+tag {
+				untag = append(untag, ref)
+			} else {
+				kept = append(kept, ref)
+			}
+		}
+		if len(untag) == 0 {
+			return fmt.Errorf("%s is not a tag of %s", name, stringid.TruncateID(img.ID))
+		}
+	}
+
+	deleteLayer := len(kept) == 0
+	if deleteLayer {
+		if reason, ok := state.inUse[img.ID]; ok {
+			return &imageInUseError{name, reason}
+		}
+		if state.children[img.ID] > 0 {
+			// Its tag can go, the layer stays for the children
+			if byID && !force {
+				return fmt.Errorf("image %s has dependent child images, use --force to untag it", name)
+			}
+			g.logger.Warnf("%s has dependent child images, its layer is kept", stringid.TruncateID(img.ID))
+			deleteLayer = false
+		}
+	}
+
+	for _, ref := range untag {
+		if !dryRun {
+			repo, tag := parsers.ParseRepositoryTag(ref)
+			if _, err := g.tagStore.Delete(repo, tag); err != nil {
+				return err
+			}
+		}
+		state.report("Untagged", ref)
+	}
+	state.tags[img.ID] = kept
+	if !deleteLayer {
+		return nil
+	}
+
+	// The parents go with it when nothing else needs them
+	for layer := img; layer != nil; {
+		if !dryRun {
+			if err := g.graphHandler.Delete(layer.ID); err != nil {
+				return err
+			}
+		}
+		state.report("Deleted", layer.ID)
+		state.deleted[layer.ID] = true
+		if layer.Parent == "" {
+			break
+		}
+		state.children[layer.Parent]--
+		if layer, err = g.removableParent(layer.Parent, state); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// imageInUseError is returned for an image a container or a dg mount uses
+type imageInUseError struct {
+	name   string
+	reason string
+}
+
+func (e *imageInUseError) Error() string {
+	return fmt.Sprintf("image %s is used by %s", e.name, e.reason)
+}
+
+// (g *GraphTool) removableParent returns the layer when it can be deleted
+// along with its last child, nil otherwise
+func (g *GraphTool) removableParent(id string, state *rmiState) (*image.Image, error) {
+	if state.children[id] > 0 || len(state.tags[id]) > 0 {
+		return nil, nil
+	}
+	if _, ok := state.inUse[id]; ok {
+		return nil, nil
+	}
+	return g.graphHandler.Get(id)
+}
+
+// containerJSON is the part of a container config.json dg needs
+type containerJSON struct {
+	ID    string
+	Name  string
+	Image string
+}
+
+// (g *GraphTool) imagesInUse returns the images the containers under the
+// docker root and the active dg mounts are made from, with what uses them
+func (g *GraphTool) imagesInUse() (map[string]string, error) {
+	inUse := map[string]string{}
+	dirs, err := ioutil.ReadDir(filepath.Join(g.DockerRoot, "containers"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		data, err := ioutil.ReadFile(filepath.Join(g.DockerRoot, "containers", dir.Name(), "config.json"))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		container := &containerJSON{}
+		if err := json.Unmarshal(data, container); err != nil {
+			return nil, fmt.Errorf("container %s: %v", dir.Name(), err)
+		}
+		if container.Image != "" {
+			inUse[container.Image] = fmt.Sprintf("container %s (%s)", stringid.TruncateID(container.ID), strings.TrimPrefix(container.Name, "/"))
+		}
+	}
+
+	records, err := g.mountStore.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		inUse[record.Image] = "the dg mount " + record.MountPoint
+	}
+	return inUse, nil
+}
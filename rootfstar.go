@@ -0,0 +1,293 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/docker/docker/pkg/symlink"
+	"github.com/opencontainers/runc/libcontainer/user"
+	"golang.org/x/sys/unix"
+)
+
+// rootfsTar writes a tree to a tar stream the way archive.TarWithOptions
+// writes layers: hardlinks, device nodes and file capabilities are kept.
+// On top of that every xattr is kept and the owners are named after the
+// /etc/passwd and /etc/group of the tree itself
+type rootfsTar struct {
+	tw     *tar.Writer
+	root   string
+	prefix string
+	seen   map[fileID]string
+	unames map[int]string
+	gnames map[int]string
+	copied int64
+}
+
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// (g *GraphTool) tarRootfs writes the tree under root to tw with its paths
+// under prefix, any error reading the tree is returned. It returns the
+// number of bytes of file content written
+func (g *GraphTool) tarRootfs(tw *tar.Writer, root string, prefix string) (int64, error) {
+	var passwd, group io.Reader
+	if path, err := symlink.FollowSymlinkInScope(filepath.Join(root, "/etc/passwd"), root); err == nil {
+		if f, err := os.Open(path); err == nil {
+			defer f.Close()
+			passwd = f
+		}
+	}
+	if path, err := symlink.FollowSymlinkInScope(filepath.Join(root, "/etc/group"), root); err == nil {
+		if f, err := os.Open(path); err == nil {
+			defer f.Close()
+			group = f
+		}
+	}
+	unames, gnames, err := ownerNames(passwd, group)
+	if err != nil {
+		return 0, err
+	}
+
+	ta := &rootfsTar{
+		tw:     tw,
+		root:   root,
+		prefix: prefix,
+		seen:   map[fileID]string{},
+		unames: unames,
+		gnames: gnames,
+	}
+
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSocket != 0 {
+			// tar can't hold sockets and they are useless once the process is gone
+			g.logger.Debugf("skipping socket %s", path)
+			return nil
+		}
+		return ta.addFile(path, info)
+	})
+	return ta.copied, err
+}
+
+// ownerNames maps the uids and gids to the names found in the passwd and
+// group files of an image, either of them can be nil
+func ownerNames(passwd, group io.Reader) (map[int]string, map[int]string, error) {
+	unames, gnames := map[int]string{}, map[int]string{}
+	if passwd != nil {
+		users, err := user.ParsePasswd(passwd)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, u := range users {
+			if _, ok := unames[u.Uid]; !ok {
+				unames[u.Uid] = u.Name
+			}
+		}
+	}
+	if group != nil {
+		groups, err := user.ParseGroup(group)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, gr := range groups {
+			if _, ok := gnames[gr.Gid]; !ok {
+				gnames[gr.Gid] = gr.Name
+			}
+		}
+	}
+	return unames, gnames, nil
+}
+
+// (ta *rootfsTar) addFile writes the header of path and its content
+func (ta *rootfsTar) addFile(path string, fi os.FileInfo) error {
+	link := ""
+	if fi.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(path); err != nil {
+			return err
+		}
+	}
+
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	hdr.Name = filepath.Join(ta.prefix, strings.TrimPrefix(path, ta.root))
+	if fi.IsDir() {
+		hdr.Name += "/"
+	}
+
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("%s: cannot convert stat value to syscall.Stat_t", path)
+	}
+	hdr.Uid = int(stat.Uid)
+	hdr.Gid = int(stat.Gid)
+	hdr.Uname = ta.unames[hdr.Uid]
+	hdr.Gname = ta.gnames[hdr.Gid]
+
+	if fi.Mode()&os.ModeDevice != 0 {
+		hdr.Devmajor = int64(unix.Major(uint64(stat.Rdev)))
+		hdr.Devminor = int64(unix.Minor(uint64(stat.Rdev)))
+	}
+
+	// The first path of a hardlinked file carries the content,
+	// the others link to it
+	if fi.Mode().IsRegular() && stat.Nlink > 1 {
+		id := fileID{uint64(stat.Dev), uint64(stat.Ino)}
+		if first, ok := ta.seen[id]; ok {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = first
+			hdr.Size = 0
+		} else {
+			ta.seen[id] = hdr.Name
+		}
+	}
+
+	if hdr.Xattrs, err = listXattrs(path); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	if err := ta.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	if hdr.Typeflag == tar.TypeReg {
+		n, err := copyFile(ta.tw, path, hdr.Size)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		ta.copied += n
+	}
+	return nil
+}
+
+// listXattrs returns the extended attributes of path. The selinux label is
+// left out, it comes from the context the bundle was mounted with, and so is
+// the opaque mark of the overlay directories read without mounting them
+func listXattrs(path string) (map[string]string, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err == unix.ENOTSUP || err == unix.EOPNOTSUPP {
+		return nil, nil
+	} else if err != nil || size == 0 {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(path, buf); err != nil {
+		return nil, err
+	}
+
+	var xattrs map[string]string
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) == 0 || string(name) == "security.selinux" || string(name) == overlayOpaqueXattr {
+			continue
+		}
+		value, err := lgetxattr(path, string(name))
+		if err != nil {
+			return nil, err
+		}
+		if xattrs == nil {
+			xattrs = map[string]string{}
+		}
+		xattrs[string(name)] = string(value)
+	}
+	return xattrs, nil
+}
+
+func lgetxattr(path string, name string) ([]byte, error) {
+	size, err := unix.Lgetxattr(path, name, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	value := make([]byte, size)
+	if size, err = unix.Lgetxattr(path, name, value); err != nil {
+		return nil, err
+	}
+	return value[:size], nil
+}
+
+// copyFile writes the size bytes of path to w. archive/tar has no sparse
+// entries, the holes of sparse files are written as zeros, SEEK_DATA and
+// SEEK_HOLE only spare reading them from disk
+func copyFile(w io.Writer, path string, size int64) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	fd := int(f.Fd())
+	unix.Fadvise(fd, 0, size, unix.FADV_SEQUENTIAL)
+
+	var written int64
+	for written < size {
+		data, err := unix.Seek(fd, written, unix.SEEK_DATA)
+		if err == unix.ENXIO {
+			// Only a hole is left
+			data = size
+		} else if err == unix.EINVAL {
+			// SEEK_DATA isn't supported, read everything
+			if _, err := f.Seek(written, os.SEEK_SET); err != nil {
+				return written, err
+			}
+			n, err := io.CopyN(w, f, size-written)
+			return written + n, err
+		} else if err != nil {
+			return written, err
+		}
+		if data > size {
+			data = size
+		}
+		if err := writeZeros(w, data-written); err != nil {
+			return written, err
+		}
+		written = data
+		if written == size {
+			break
+		}
+
+		hole, err := unix.Seek(fd, written, unix.SEEK_HOLE)
+		if err != nil {
+			return written, err
+		}
+		if hole > size {
+			hole = size
+		}
+		if _, err := f.Seek(written, os.SEEK_SET); err != nil {
+			return written, err
+		}
+		n, err := io.CopyN(w, f, hole-written)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+var zeros = make([]byte, 32*1024)
+
+func writeZeros(w io.Writer, n int64) error {
+	for n > 0 {
+		chunk := int64(len(zeros))
+		if n < chunk {
+			chunk = n
+		}
+		if _, err := w.Write(zeros[:chunk]); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/pkg/archive"
+	"golang.org/x/sys/unix"
+)
+
+// buildTree creates a tree with every kind of entry the rootfs tar keeps
+func buildTree(t *testing.T, root string) {
+	mustWrite := func(name, content string, mode os.FileMode) {
+		if err := ioutil.WriteFile(filepath.Join(root, name), []byte(content), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, dir := range []string{"etc", "bin", "usr/lib", "dev"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustWrite("etc/passwd", "root:x:0:0:root:/root:/bin/sh\napp:x:1000:1000::/home/app:/bin/sh\n", 0644)
+	mustWrite("etc/group", "root:x:0:\napp:x:1000:\n", 0644)
+	mustWrite("bin/tool", "#!/bin/sh\necho tool\n", 0755)
+	if err := os.Link(filepath.Join(root, "bin/tool"), filepath.Join(root, "bin/tool-alias")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../bin/tool", filepath.Join(root, "usr/lib/tool")); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mkfifo(filepath.Join(root, "dev/fifo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// A sparse file, with data on both sides of a hole
+	f, err := os.Create(filepath.Join(root, "usr/lib/sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("head")
+	f.WriteAt([]byte("tail"), 4<<20)
+	f.Close()
+
+	if os.Getuid() == 0 {
+		if err := syscall.Mknod(filepath.Join(root, "dev/null"), syscall.S_IFCHR|0666, int(unix.Mkdev(1, 3))); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Lchown(filepath.Join(root, "bin/tool"), 1000, 1000); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := unix.Lsetxattr(filepath.Join(root, "bin/tool"), "user.dg-test", []byte("value"), 0); err != nil && err != unix.ENOTSUP {
+		t.Fatal(err)
+	}
+}
+
+// compareTrees fails the test when dst doesn't hold the same entries as src
+// with the same type, mode, owner, content, link target, xattrs and hardlinks
+func compareTrees(t *testing.T, src, dst string) {
+	links := map[uint64]uint64{}
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, path)
+		other, err := os.Lstat(filepath.Join(dst, rel))
+		if err != nil {
+			t.Errorf("%s: %v", rel, err)
+			return nil
+		}
+		if rel == "." {
+			return nil
+		}
+		if info.Mode() != other.Mode() {
+			t.Errorf("%s: mode %v, want %v", rel, other.Mode(), info.Mode())
+			return nil
+		}
+		stat, otherStat := info.Sys().(*syscall.Stat_t), other.Sys().(*syscall.Stat_t)
+		if os.Getuid() == 0 && (stat.Uid != otherStat.Uid || stat.Gid != otherStat.Gid) {
+			t.Errorf("%s: owner %d:%d, want %d:%d", rel, otherStat.Uid, otherStat.Gid, stat.Uid, stat.Gid)
+		}
+		if info.Mode()&os.ModeDevice != 0 && stat.Rdev != otherStat.Rdev {
+			t.Errorf("%s: device %d, want %d", rel, otherStat.Rdev, stat.Rdev)
+		}
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			want, _ := os.Readlink(path)
+			if got, _ := os.Readlink(filepath.Join(dst, rel)); got != want {
+				t.Errorf("%s: link to %s, want %s", rel, got, want)
+			}
+		case info.Mode().IsRegular():
+			want, _ := ioutil.ReadFile(path)
+			if got, _ := ioutil.ReadFile(filepath.Join(dst, rel)); !bytes.Equal(got, want) {
+				t.Errorf("%s: content differs", rel)
+			}
+			if stat.Nlink > 1 {
+				if ino, ok := links[stat.Ino]; ok && ino != otherStat.Ino {
+					t.Errorf("%s: not hardlinked", rel)
+				}
+				links[stat.Ino] = otherStat.Ino
+			}
+		}
+
+		want, err := listXattrs(path)
+		if err != nil {
+			return err
+		}
+		got, err := listXattrs(filepath.Join(dst, rel))
+		if err != nil {
+			return err
+		}
+		for name, value := range want {
+			if got[name] != value {
+				t.Errorf("%s: xattr %s is %q, want %q", rel, name, got[name], value)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRootfsTarRoundTrip(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "dg-rootfstar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	src, dst := filepath.Join(tmp, "src"), filepath.Join(tmp, "dst")
+	for _, dir := range []string{src, dst} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buildTree(t, src)
+
+	g := &GraphTool{logger: logrus.New()}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	copied, err := g.tarRootfs(tw, src, "rootfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// The hardlinked content is written once, the sparse file with its holes
+	var want int64
+	seen := map[uint64]bool{}
+	filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() && !seen[info.Sys().(*syscall.Stat_t).Ino] {
+			seen[info.Sys().(*syscall.Stat_t).Ino] = true
+			want += info.Size()
+		}
+		return nil
+	})
+	if copied != want {
+		t.Errorf("copied %d bytes of content, want %d", copied, want)
+	}
+
+	// The owner names come from the tree
+	tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		if hdr.Name == "rootfs/bin/tool" && os.Getuid() == 0 && (hdr.Uname != "app" || hdr.Gname != "app") {
+			t.Errorf("bin/tool is owned by %s:%s, want app:app", hdr.Uname, hdr.Gname)
+		}
+	}
+
+	options := &archive.TarOptions{NoLchown: os.Getuid() != 0}
+	if err := archive.Untar(bytes.NewReader(buf.Bytes()), dst, options); err != nil {
+		t.Fatal(err)
+	}
+	compareTrees(t, src, filepath.Join(dst, "rootfs"))
+}
+
+func TestRootfsTarSparseFile(t *testing.T) {
+	src, err := ioutil.TempDir("", "dg-rootfstar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+
+	const size = 4<<20 + 4
+	f, err := os.Create(filepath.Join(src, "sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("head")
+	f.WriteAt([]byte("tail"), size-4)
+	f.Close()
+
+	g := &GraphTool{logger: logrus.New()}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if _, err := g.tarRootfs(tw, src, "rootfs"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// tar has no holes, the file is a regular entry of its full size
+	if buf.Len() < size {
+		t.Errorf("the archive is %d bytes, want at least %d", buf.Len(), size)
+	}
+	tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatal("rootfs/sparse is missing")
+		}
+		if hdr.Name != "rootfs/sparse" {
+			continue
+		}
+		if hdr.Typeflag != tar.TypeReg || hdr.Size != size {
+			t.Errorf("rootfs/sparse is a %c entry of %d bytes, want a regular file of %d", hdr.Typeflag, hdr.Size, size)
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content[:4]) != "head" || string(content[size-4:]) != "tail" || bytes.Count(content, []byte{0}) != size-8 {
+			t.Errorf("rootfs/sparse content differs")
+		}
+		break
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/docker/docker/registry"
+)
+
+// (g *GraphTool) Save writes the images names with their parent layers and
+// tags to dst like docker save, "-" is stdout. A repository name saves all
+// its tags. compression is a --compress value, guessed from dst when empty
+func (g *GraphTool) Save(names []string, dst, compression string) error {
+	for _, name := range names {
+		if g.tagStore.Repositories[registry.NormalizeLocalName(name)] != nil {
+			continue
+		}
+		img, err := g.LookupImage(name)
+		if err != nil {
+			return err
+		}
+		if img == nil {
+			return fmt.Errorf("image %s not found", name)
+		}
+	}
+	c, err := parseCompression(compression, dst)
+	if err != nil {
+		return err
+	}
+
+	out, err := createOutput(dst, c)
+	if err != nil {
+		return err
+	}
+	if err := g.tagStore.ImageExport(names, out); err != nil {
+		out.Close()
+		if dst != "-" {
+			os.Remove(dst)
+		}
+		return err
+	}
+	return out.Close()
+}
+
+// (g *GraphTool) Load registers the images of a docker save archive src, "-"
+// is stdin, and tags them as listed in its repositories file. The archive can
+// be compressed, the layers already in the graph are skipped
+func (g *GraphTool) Load(src string) error {
+	unlock, err := g.lockGraph()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	var in io.ReadCloser = ioutil.NopCloser(os.Stdin)
+	if src != "-" {
+		f, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		in = f
+	}
+	defer in.Close()
+
+	before := len(g.graphHandler.Map())
+	if err := g.tagStore.Load(in, os.Stdout); err != nil {
+		return err
+	}
+	fmt.Printf("Loaded %d new layers\n", len(g.graphHandler.Map())-before)
+	return nil
+}
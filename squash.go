@@ -0,0 +1,131 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/parsers"
+	"github.com/docker/docker/pkg/stringid"
+	"github.com/docker/docker/pkg/units"
+)
+
+// (g *GraphTool) Squash merges the layers of imageName into a single layer
+// and tags the new image as repoTag, the config of imageName is kept. With
+// from, a layer id or an image of the history, only the layers above it are
+// merged and the new layer is put on top of it. The whole image is merged from
+// the layer tars without mounting it, squashing above from mounts both ends to
+// find the files deleted in between. The size saved is reported on stderr
+func (g *GraphTool) Squash(imageName, repoTag, from string) (*image.Image, error) {
+	repo, tag := parsers.ParseRepositoryTag(repoTag)
+	if repo == "" {
+		return nil, fmt.Errorf("invalid repository name %q", repoTag)
+	}
+	unlock, err := g.lockGraph()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	img, err := g.LookupImage(imageName)
+	if err != nil {
+		return nil, err
+	}
+	if img == nil {
+		return nil, fmt.Errorf("image %s not found", imageName)
+	}
+	history, err := g.imageHistory(img)
+	if err != nil {
+		return nil, err
+	}
+
+	var base *image.Image
+	if from != "" {
+		if base, err = g.historyLayer(imageName, history, from); err != nil {
+			return nil, err
+		}
+	}
+
+	// The layers that go away, top first
+	squashed := []*image.Image{}
+	var before int64
+	for _, layer := range history {
+		if base != nil && layer.ID == base.ID {
+			break
+		}
+		squashed = append(squashed, layer)
+		before += layer.Size
+	}
+	if len(squashed) < 2 {
+		return nil, fmt.Errorf("nothing to squash, %s has a single layer to merge", imageName)
+	}
+
+	var layer io.ReadCloser
+	if base == nil {
+		rootfs, err := g.newLayerRootfs(img)
+		if err != nil {
+			return nil, err
+		}
+		r, w := io.Pipe()
+		go func() {
+			tw := tar.NewWriter(w)
+			_, err := rootfs.writeTo(tw, ".")
+			if err == nil {
+				err = tw.Close()
+			}
+			w.CloseWithError(err)
+		}()
+		layer = r
+	} else {
+		top, cleanupTop, err := g.mountView(img)
+		if err != nil {
+			return nil, err
+		}
+		defer cleanupTop()
+		lower, cleanupLower, err := g.mountView(base)
+		if err != nil {
+			return nil, err
+		}
+		defer cleanupLower()
+
+		changes, err := archive.ChangesDirs(top, lower)
+		if err != nil {
+			return nil, err
+		}
+		if layer, err = archive.ExportChanges(top, changes); err != nil {
+			return nil, err
+		}
+	}
+	defer layer.Close()
+
+	ids := make([]string, 0, len(squashed))
+	for _, layer := range squashed {
+		ids = append(ids, layer.ID)
+	}
+	newImg, err := newChildImage(base, "Squashed "+strings.Join(ids, " "), img.Config, fmt.Sprintf("dg squash of %d layers", len(squashed)))
+	if err != nil {
+		return nil, err
+	}
+	newImg.Author = img.Author
+	if err := g.registerImage(newImg, layer, repo, tag); err != nil {
+		return nil, err
+	}
+
+	// Register measured the new layer
+	if newImg, err = g.graphHandler.Get(newImg.ID); err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(os.Stderr, "Squashed %d layers of %s into %s: %s -> %s, saved %s\n",
+		len(squashed),
+		imageName,
+		stringid.TruncateID(newImg.ID),
+		units.HumanSize(float64(before)),
+		units.HumanSize(float64(newImg.Size)),
+		units.HumanSize(float64(before-newImg.Size)),
+	)
+	return newImg, nil
+}
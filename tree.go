@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/pkg/stringid"
+	"github.com/docker/docker/pkg/units"
+)
+
+const outputDot = "dot"
+
+// TreeNode is a layer of dg tree with the layers built on top of it
+type TreeNode struct {
+	ID          string    `json:"id"`
+	ParentID    string    `json:"parent_id,omitempty"`
+	Created     time.Time `json:"created"`
+	Size        int64     `json:"size"`
+	VirtualSize int64     `json:"virtual_size"`
+	Tags        []string  `json:"tags"`
+	Head        bool      `json:"head"`
+	// Dangling is set when neither the layer nor its children are tagged
+	Dangling bool        `json:"dangling"`
+	Depth    int         `json:"depth"`
+	Children []*TreeNode `json:"children"`
+}
+
+// (g *GraphTool) layerForest returns the roots of the layer forest, base layers first
+func (g *GraphTool) layerForest() []*TreeNode {
+	all := g.graphHandler.Map()
+	byParent := g.graphHandler.ByParent()
+	heads := g.graphHandler.Heads()
+	byID := g.tagStore.ByID()
+
+	var build func(img *image.Image, depth int, parentSize int64) *TreeNode
+	build = func(img *image.Image, depth int, parentSize int64) *TreeNode {
+		_, head := heads[img.ID]
+		tags := byID[img.ID]
+		if tags == nil {
+			tags = []string{}
+		}
+		node := &TreeNode{
+			ID:          img.ID,
+			ParentID:    img.Parent,
+			Created:     img.Created.UTC(),
+			Size:        img.Size,
+			VirtualSize: parentSize + img.Size,
+			Tags:        tags,
+			Head:        head,
+			Dangling:    len(tags) == 0,
+			Depth:       depth,
+			Children:    []*TreeNode{},
+		}
+		children := byParent[img.ID]
+		sort.Sort(byCreated(children))
+		for _, child := range children {
+			childNode := build(child, depth+1, node.VirtualSize)
+			node.Children = append(node.Children, childNode)
+			if !childNode.Dangling {
+				node.Dangling = false
+			}
+		}
+		return node
+	}
+
+	roots := []*image.Image{}
+	for _, img := range all {
+		// Layers whose parent is missing from the graph are roots too
+		if _, ok := all[img.Parent]; img.Parent == "" || !ok {
+			roots = append(roots, img)
+		}
+	}
+	sort.Sort(byCreated(roots))
+
+	forest := []*TreeNode{}
+	for _, root := range roots {
+		forest = append(forest, build(root, 0, 0))
+	}
+	return forest
+}
+
+// byCreated sorts images by creation time, the id breaks ties
+type byCreated []*image.Image
+
+func (r byCreated) Len() int      { return len(r) }
+func (r byCreated) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r byCreated) Less(i, j int) bool {
+	if r[i].Created.Equal(r[j].Created) {
+		return r[i].ID < r[j].ID
+	}
+	return r[i].Created.Before(r[j].Created)
+}
+
+// walkForest calls fn for every node of the forest, parents first
+func walkForest(nodes []*TreeNode, fn func(node *TreeNode)) {
+	for _, node := range nodes {
+		fn(node)
+		walkForest(node.Children, fn)
+	}
+}
+
+// (g *GraphTool) Tree prints the layer forest of the graph with the tags on its
+// nodes. format is table (an ascii tree), json (nested nodes), dot (Graphviz)
+// or a Go template applied to each node
+func (g *GraphTool) Tree(format string) error {
+	forest := g.layerForest()
+
+	switch format {
+	case outputJSON:
+		return printJSON(os.Stdout, forest)
+	case outputDot:
+		return printDot(os.Stdout, forest)
+	}
+
+	items := []interface{}{}
+	walkForest(forest, func(node *TreeNode) {
+		items = append(items, node)
+	})
+	return printOutput(format, items, func(w *tabwriter.Writer) {
+		printTree(w, forest, "")
+	})
+}
+
+// printTree prints nodes as an ascii tree, prefix is the indentation of the level
+func printTree(w io.Writer, nodes []*TreeNode, prefix string) {
+	for i, node := range nodes {
+		branch, indent := "├─", "│ "
+		if i == len(nodes)-1 {
+			branch, indent = "└─", "  "
+		}
+		line := fmt.Sprintf("%s%s%s Virtual Size: %s", prefix, branch, stringid.TruncateID(node.ID), units.HumanSize(float64(node.VirtualSize)))
+		if len(node.Tags) > 0 {
+			line += " Tags: " + strings.Join(node.Tags, ", ")
+		} else if node.Head {
+			line += " (dangling)"
+		}
+		fmt.Fprintln(w, line)
+		printTree(w, node.Children, prefix+indent)
+	}
+}
+
+// printDot prints the forest as a Graphviz digraph, the tagged layers are
+// filled and the branches that lead to no tag are grey
+func printDot(w io.Writer, forest []*TreeNode) error {
+	fmt.Fprintln(w, "digraph docker {")
+	walkForest(forest, func(node *TreeNode) {
+		id := stringid.TruncateID(node.ID)
+		if node.Depth == 0 {
+			fmt.Fprintf(w, "  base -> \"%s\" [style=invis]\n", id)
+		} else {
+			fmt.Fprintf(w, "  \"%s\" -> \"%s\"\n", stringid.TruncateID(node.ParentID), id)
+		}
+		switch {
+		case len(node.Tags) > 0:
+			fmt.Fprintf(w, "  \"%s\" [label=\"%s\\n%s\",shape=box,fillcolor=\"paleturquoise\",style=\"filled,rounded\"];\n", id, id, strings.Join(node.Tags, "\\n"))
+		case node.Dangling:
+			fmt.Fprintf(w, "  \"%s\" [color=\"grey\",fontcolor=\"grey\"];\n", id)
+		}
+	})
+	fmt.Fprintln(w, "  base [style=invisible]")
+	_, err := fmt.Fprintln(w, "}")
+	return err
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/docker/docker/graph"
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/ioutils"
+	"github.com/docker/docker/pkg/stringid"
+	"github.com/docker/docker/pkg/tarsum"
+	"github.com/vbatts/tar-split/tar/asm"
+	"github.com/vbatts/tar-split/tar/storage"
+)
+
+// tarDataFile is the tar-split metadata the graph keeps to reassemble a layer tar
+const tarDataFile = "tar-data.json.gz"
+
+// Results of dg verify for a layer
+const (
+	verifyOK         = "ok"
+	verifyUnverified = "unverified"
+	verifyMismatch   = "mismatch"
+	verifyModified   = "modified"
+	verifyBroken     = "broken"
+)
+
+// VerifyRow is the integrity of a layer. Status is ok when the layer tar
+// matches the recorded digest, unverified when there is no digest or only the
+// digest of a gzip blob that can't be reproduced while tar-split checked the
+// files, mismatch when it doesn't match, modified when the files don't match
+// the tar-split checksums and broken when the tar can't be reassembled
+type VerifyRow struct {
+	ID       string   `json:"id"`
+	Tags     []string `json:"tags"`
+	Status   string   `json:"status"`
+	Recorded string   `json:"recorded,omitempty"`
+	SHA256   string   `json:"sha256,omitempty"`
+	TarSum   string   `json:"tarsum,omitempty"`
+	TarSplit bool     `json:"tar_split"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// (g *GraphTool) Verify re-tars the layers of images, all of them when none is
+// given, and checks their sha256 and tarsum against the digests recorded on
+// pull and push. The layers with tar-split metadata are reassembled from it, so
+// the checksum of every file is checked too. It fails when a layer doesn't pass
+func (g *GraphTool) Verify(imageNames []string, format string) error {
+	layers := []*image.Image{}
+	if len(imageNames) == 0 {
+		for _, img := range g.graphHandler.Map() {
+			layers = append(layers, img)
+		}
+	} else {
+		seen := map[string]bool{}
+		for _, name := range imageNames {
+			img, err := g.LookupImage(name)
+			if err != nil {
+				return err
+			}
+			if img == nil {
+				return fmt.Errorf("image %s not found", name)
+			}
+			history, err := g.imageHistory(img)
+			if err != nil {
+				return err
+			}
+			for _, layer := range history {
+				if !seen[layer.ID] {
+					seen[layer.ID] = true
+					layers = append(layers, layer)
+				}
+			}
+		}
+	}
+	sort.Sort(byCreated(layers))
+
+	byID := g.tagStore.ByID()
+	rows := []*VerifyRow{}
+	failed := 0
+	for _, layer := range layers {
+		row := g.verifyLayer(layer)
+		if row.Tags = byID[layer.ID]; row.Tags == nil {
+			row.Tags = []string{}
+		}
+		if row.Status != verifyOK && row.Status != verifyUnverified {
+			failed++
+		}
+		rows = append(rows, row)
+	}
+
+	items := make([]interface{}, 0, len(rows))
+	for _, row := range rows {
+		items = append(items, row)
+	}
+	err := printOutput(format, items, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "LAYER ID\tSTATUS\tTAR-SPLIT\tRECORDED DIGEST\tDETAIL")
+		for _, row := range rows {
+			recorded := row.Recorded
+			if recorded == "" {
+				recorded = "<none>"
+			}
+			detail := row.Error
+			if detail == "" && row.Status == verifyMismatch {
+				detail = row.SHA256
+			}
+			fmt.Fprintf(w, "%s\t%s\t%t\t%s\t%s\n",
+				stringid.TruncateID(row.ID),
+				row.Status,
+				row.TarSplit,
+				recorded,
+				detail,
+			)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d layers failed verification", failed, len(rows))
+	}
+	return nil
+}
+
+// (g *GraphTool) verifyLayer checksums the tar of layer
+func (g *GraphTool) verifyLayer(layer *image.Image) *VerifyRow {
+	row := &VerifyRow{ID: layer.ID}
+	if _, err := os.Stat(filepath.Join(g.DockerRoot, "graph", layer.ID, tarDataFile)); err == nil {
+		row.TarSplit = true
+	}
+
+	recorded, err := g.graphHandler.GetDigest(layer.ID)
+	if err != nil && err != graph.ErrDigestNotSet {
+		row.Status, row.Error = verifyBroken, err.Error()
+		return row
+	}
+	row.Recorded = recorded.String()
+
+	// tarsum digests are checked with their own version and hash
+	label := "tarsum.v1+sha256"
+	if strings.HasPrefix(row.Recorded, "tarsum") {
+		label = row.Recorded[:strings.LastIndex(row.Recorded, ":")]
+	}
+
+	// TarLayer would fall back to the driver differ when the reassembly fails
+	var rdr io.ReadCloser
+	if row.TarSplit {
+		rdr, err = g.tarSplitLayer(layer)
+	} else {
+		rdr, err = g.graphDriver.Diff(layer.ID, layer.Parent)
+	}
+	if err != nil {
+		row.Status, row.Error = verifyBroken, err.Error()
+		return row
+	}
+	defer rdr.Close()
+
+	// The digest of a pulled layer can be the one of its gzip blob
+	sum, gzipSum := sha256.New(), sha256.New()
+	gz, err := archive.CompressStream(ioutils.NopWriteCloser(gzipSum), archive.Gzip)
+	if err != nil {
+		row.Status, row.Error = verifyBroken, err.Error()
+		return row
+	}
+	ts, err := tarsum.NewTarSumForLabel(io.TeeReader(rdr, io.MultiWriter(sum, gz)), true, label)
+	if err != nil {
+		row.Status, row.Error = verifyBroken, err.Error()
+		return row
+	}
+	if _, err := io.Copy(ioutil.Discard, ts); err != nil {
+		row.Status, row.Error = verifyBroken, err.Error()
+		// The reassembly checks the crc64 of every file
+		if strings.Contains(err.Error(), "file integrity checksum failed") {
+			row.Status = verifyModified
+		}
+		return row
+	}
+	if err := gz.Close(); err != nil {
+		row.Status, row.Error = verifyBroken, err.Error()
+		return row
+	}
+	row.SHA256 = "sha256:" + hex.EncodeToString(sum.Sum(nil))
+	row.TarSum = ts.Sum(nil)
+
+	switch row.Recorded {
+	case "":
+		row.Status = verifyUnverified
+	case row.SHA256, row.TarSum, "sha256:" + hex.EncodeToString(gzipSum.Sum(nil)):
+		row.Status = verifyOK
+	default:
+		row.Status = verifyMismatch
+		// A sha256 recorded on pull or push is the one of the gzip blob, the
+		// blob may have been compressed differently. The files were still
+		// checked against the tar-split checksums, without them it stays a mismatch
+		if row.TarSplit && !strings.HasPrefix(row.Recorded, "tarsum") {
+			row.Status = verifyUnverified
+			row.Error = "recorded digest of a gzip blob that can't be reproduced"
+		}
+	}
+	return row
+}
+
+// (g *GraphTool) tarSplitLayer reassembles the tar of layer from its tar-split
+// metadata and the files of the layer, the reassembly fails when a file doesn't
+// match its checksum. The aufs layers are read from their diff directory
+func (g *GraphTool) tarSplitLayer(layer *image.Image) (io.ReadCloser, error) {
+	mf, err := os.Open(filepath.Join(g.DockerRoot, "graph", layer.ID, tarDataFile))
+	if err != nil {
+		return nil, err
+	}
+	mfz, err := gzip.NewReader(mf)
+	if err != nil {
+		mf.Close()
+		return nil, fmt.Errorf("%s: %v", mf.Name(), err)
+	}
+
+	root, release := filepath.Join(g.DockerRoot, "aufs", "diff", layer.ID), func() {}
+	if g.graphDriver.String() != "aufs" {
+		if root, err = g.graphDriver.Get(layer.ID, ""); err != nil {
+			mf.Close()
+			return nil, err
+		}
+		release = func() {
+			if err := g.graphDriver.Put(layer.ID); err != nil {
+				g.logger.Warnf("put %s: %v", layer.ID, err)
+			}
+		}
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		defer release()
+		defer mf.Close()
+		ots := asm.NewOutputTarStream(storage.NewPathFileGetter(root), storage.NewJSONUnpacker(mfz))
+		defer ots.Close()
+		_, err := io.Copy(pw, ots)
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}